@@ -0,0 +1,54 @@
+// Package brotlichi adapts brotli.Handler to chi, letting filters match
+// chi route patterns such as /users/{id}.
+package brotlichi
+
+import (
+	"net/http"
+
+	"github.com/CodeLineage/brotli"
+	"github.com/go-chi/chi/v5"
+)
+
+// Middleware returns chi middleware compressing responses with handler,
+// filters see the route pattern the request matches
+func Middleware(handler *brotli.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		compress := handler.HTTP(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if pattern := RoutePattern(req); pattern != "" {
+				req = brotli.WithRoutePattern(req, pattern)
+			}
+			compress.ServeHTTP(w, req)
+		})
+	}
+}
+
+// RoutePattern extracts the chi route pattern req matches, it's
+// usable as brotli.Config.RoutePattern
+//
+// Middleware registered with Use runs before chi routes the request,
+// so the pattern is looked up from the root routes.
+func RoutePattern(req *http.Request) string {
+	rctx := chi.RouteContext(req.Context())
+	if rctx == nil {
+		return ""
+	}
+	if rctx.Routes == nil {
+		return rctx.RoutePattern()
+	}
+
+	// 根路由上被中间件改写的路径
+	path := rctx.RoutePath
+	if path == "" || len(rctx.RoutePatterns) > 0 {
+		if path = req.URL.RawPath; path == "" {
+			path = req.URL.Path
+		}
+	}
+
+	// 以新的路由上下文匹配，避免影响当前请求
+	tctx := chi.NewRouteContext()
+	if !rctx.Routes.Match(tctx, req.Method, path) {
+		return ""
+	}
+	return tctx.RoutePattern()
+}
@@ -0,0 +1,90 @@
+package brotlichi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CodeLineage/brotli"
+	abbrotli "github.com/andybalholm/brotli"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var payload = bytes.Repeat([]byte(`{"code":0,"msg":"success"},`), 100)
+
+func newChiInstance(middleware func(http.Handler) http.Handler) *chi.Mux {
+	handle := func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(payload)
+	}
+
+	r := chi.NewRouter()
+	r.Use(middleware)
+	r.Get("/users/{id}", handle)
+	r.Get("/other/{id}", handle)
+	r.Route("/api", func(r chi.Router) {
+		r.Get("/items/{id}", handle)
+	})
+	return r
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := brotli.NewHandler(brotli.Config{
+		RequestFilter: []brotli.RequestFilter{
+			brotli.NewCommonRequestFilter(),
+			brotli.NewRequestApiFilter([]string{"/users/{id}", "/api/items/{id}"}),
+		},
+	})
+	r := newChiInstance(Middleware(handler))
+
+	for path, encoding := range map[string]string{
+		"/users/1":     "br",
+		"/api/items/1": "br",
+		"/other/1":     "",
+	} {
+		var (
+			w   = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, path, nil)
+		)
+		req.Header.Set("Accept-Encoding", "br")
+		r.ServeHTTP(w, req)
+
+		result := w.Result()
+		require.Equal(t, http.StatusOK, result.StatusCode, path)
+		require.Equal(t, encoding, result.Header.Get("Content-Encoding"), path)
+		if encoding == "br" {
+			body, err := ioutil.ReadAll(abbrotli.NewReader(result.Body))
+			require.NoError(t, err)
+			assert.Equal(t, payload, body, path)
+		}
+	}
+}
+
+func TestRoutePattern(t *testing.T) {
+	handler := brotli.NewHandler(brotli.Config{
+		RoutePattern: RoutePattern,
+		RequestFilter: []brotli.RequestFilter{
+			brotli.NewRequestApiFilter([]string{"/api/items/{id}"}),
+		},
+	})
+	r := newChiInstance(handler.HTTP)
+
+	for path, encoding := range map[string]string{
+		"/api/items/1": "br",
+		"/users/1":     "",
+	} {
+		var (
+			w   = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, path, nil)
+		)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, encoding, w.Result().Header.Get("Content-Encoding"), path)
+	}
+
+	// outside of chi
+	assert.Empty(t, RoutePattern(httptest.NewRequest(http.MethodGet, "/users/1", nil)))
+}
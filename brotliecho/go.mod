@@ -0,0 +1,12 @@
+module github.com/CodeLineage/brotli/brotliecho
+
+go 1.15
+
+require (
+	github.com/CodeLineage/brotli v0.0.0-00010101000000-000000000000
+	github.com/andybalholm/brotli v1.0.2
+	github.com/labstack/echo/v4 v4.1.17
+	github.com/stretchr/testify v1.5.1
+)
+
+replace github.com/CodeLineage/brotli => ../
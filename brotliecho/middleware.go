@@ -0,0 +1,38 @@
+// Package brotliecho adapts brotli.Handler to echo, swapping the writer
+// of echo.Response for the time of a request.
+package brotliecho
+
+import (
+	"github.com/CodeLineage/brotli"
+	"github.com/labstack/echo/v4"
+)
+
+// Middleware returns echo middleware compressing responses with handler
+//
+// echo.Response.Writer is replaced during the request, so Before and After
+// hooks as well as Committed keep their meaning.
+func Middleware(handler *brotli.Handler) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			response := ctx.Response()
+			if response.Committed {
+				return next(ctx)
+			}
+
+			writer := handler.Wrap(response.Writer, ctx.Request())
+			if writer == nil {
+				return next(ctx)
+			}
+
+			originWriter := response.Writer
+			response.Writer = writer
+			defer func() {
+				// 资源回收
+				writer.Close()
+				response.Writer = originWriter
+			}()
+
+			return next(ctx)
+		}
+	}
+}
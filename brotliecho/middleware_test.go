@@ -0,0 +1,85 @@
+package brotliecho
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CodeLineage/brotli"
+	abbrotli "github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var payload = bytes.Repeat([]byte(`{"code":0,"msg":"success"},`), 100)
+
+func newEchoInstance() *echo.Echo {
+	e := echo.New()
+	e.Use(Middleware(brotli.DefaultHandler()))
+
+	e.GET("/", func(ctx echo.Context) error {
+		ctx.Response().Before(func() {
+			ctx.Response().Header().Set("X-Before", "1")
+		})
+		return ctx.Blob(http.StatusOK, echo.MIMEApplicationJSON, payload)
+	})
+	e.GET("/small", func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, map[string]int{"code": 0})
+	})
+	e.GET("/error", func(ctx echo.Context) error {
+		return echo.NewHTTPError(http.StatusTeapot, "teapot")
+	})
+	return e
+}
+
+func TestMiddleware(t *testing.T) {
+	var (
+		e = newEchoInstance()
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+	)
+	r.Header.Set("Accept-Encoding", "br")
+	e.ServeHTTP(w, r)
+
+	result := w.Result()
+	require.EqualValues(t, http.StatusOK, result.StatusCode)
+	require.Equal(t, "br", result.Header.Get("Content-Encoding"))
+	assert.Equal(t, "1", result.Header.Get("X-Before"))
+
+	body, err := ioutil.ReadAll(abbrotli.NewReader(result.Body))
+	require.NoError(t, err)
+	assert.Equal(t, payload, body)
+}
+
+func TestMiddleware_Identity(t *testing.T) {
+	var e = newEchoInstance()
+
+	for path, status := range map[string]int{
+		"/small": http.StatusOK,
+		"/error": http.StatusTeapot,
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, path, nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		e.ServeHTTP(w, r)
+
+		result := w.Result()
+		assert.EqualValues(t, status, result.StatusCode, path)
+		assert.Empty(t, result.Header.Get("Content-Encoding"), path)
+		assert.NotZero(t, w.Body.Len(), path)
+	}
+
+	// no br
+	var (
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+	)
+	e.ServeHTTP(w, r)
+	assert.Empty(t, w.Result().Header.Get("Content-Encoding"))
+	assert.Equal(t, payload, w.Body.Bytes())
+}
@@ -0,0 +1,12 @@
+module github.com/CodeLineage/brotli/brotlifasthttp
+
+go 1.15
+
+require (
+	github.com/CodeLineage/brotli v0.0.0-00010101000000-000000000000
+	github.com/andybalholm/brotli v1.0.2
+	github.com/stretchr/testify v1.5.1
+	github.com/valyala/fasthttp v1.16.0
+)
+
+replace github.com/CodeLineage/brotli => ../
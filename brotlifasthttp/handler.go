@@ -0,0 +1,299 @@
+// Package brotlifasthttp adapts brotli.Handler to fasthttp and frameworks
+// built on it such as fiber.
+package brotlifasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/CodeLineage/brotli"
+	abbrotli "github.com/andybalholm/brotli"
+	"github.com/valyala/fasthttp"
+)
+
+// streamUserValue is the user value key of bodies set by SetBodyStream
+const streamUserValue = "brotlifasthttp.stream"
+
+// Handler compresses fasthttp responses according to
+// the current Config of a brotli.Handler, following its updates
+//
+// Bodies are compressed with pooled brotli writers. fasthttp gives no
+// access to a stream set on the response, so streamed bodies are only
+// compressed when set by SetBodyStream or SetBodyStreamWriter of this
+// package. ContentDigest, CompressionTrailers and ServerTiming apply to
+// net/http writers only.
+type Handler struct {
+	handler *brotli.Handler
+	// 按压缩等级区分的brotli writer
+	brotliWriterPools [brotli.BestCompression + 1]sync.Pool
+}
+
+// New creates a Handler sharing configuration with handler
+func New(handler *brotli.Handler) *Handler {
+	h := Handler{handler: handler}
+
+	for level := range h.brotliWriterPools {
+		level := level
+		// brotli writer
+		h.brotliWriterPools[level].New = func() interface{} {
+			return abbrotli.NewWriterLevel(ioutil.Discard, level)
+		}
+	}
+
+	return &h
+}
+
+// SetBodyStream sets the response body stream of ctx as
+// ctx.SetBodyStream does, leaving it for Middleware to compress
+func SetBodyStream(ctx *fasthttp.RequestCtx, bodyStream io.Reader, bodySize int) {
+	body := &stream{reader: bodyStream}
+	ctx.SetBodyStream(body, bodySize)
+	ctx.SetUserValue(streamUserValue, body)
+}
+
+// SetBodyStreamWriter sets the response body stream writer of ctx as
+// ctx.SetBodyStreamWriter does, leaving it for Middleware to compress
+func SetBodyStreamWriter(ctx *fasthttp.RequestCtx, sw fasthttp.StreamWriter) {
+	SetBodyStream(ctx, fasthttp.NewStreamReader(sw), -1)
+}
+
+// Middleware wraps next, compressing the responses it sets
+//
+// With fiber it's used as
+//
+//	app.Use(func(c *fiber.Ctx) (err error) {
+//		h.Middleware(func(*fasthttp.RequestCtx) { err = c.Next() })(c.Context())
+//		return err
+//	})
+func (h *Handler) Middleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		req, err := convertRequest(ctx)
+		if err != nil {
+			next(ctx)
+			return
+		}
+
+		negotiation := h.handler.Negotiate(req)
+		// 条件请求头可能已去除编码后缀
+		for _, key := range []string{"If-None-Match", "If-Match"} {
+			if len(ctx.Request.Header.Peek(key)) > 0 {
+				ctx.Request.Header.Set(key, strings.Join(req.Header.Values(key), ", "))
+			}
+		}
+
+		next(ctx)
+		h.compress(ctx, negotiation)
+	}
+}
+
+// compress compresses ctx.Response if negotiation allows
+func (h *Handler) compress(ctx *fasthttp.RequestCtx, negotiation *brotli.Negotiation) {
+	if !ctx.Response.IsBodyStream() {
+		h.compressBody(ctx, negotiation)
+		return
+	}
+
+	// 仅接管本包设置的流
+	if body, ok := ctx.UserValue(streamUserValue).(*stream); ok {
+		h.compressStream(ctx, negotiation, body)
+	}
+}
+
+// compressBody compresses the in-memory body of ctx.Response
+func (h *Handler) compressBody(ctx *fasthttp.RequestCtx, negotiation *brotli.Negotiation) {
+	response := &ctx.Response
+	header := convertResponseHeader(&response.Header)
+	body := response.Body()
+	if !negotiation.Decide(response.StatusCode(), header, body, int64(len(body))) {
+		syncHeader(response, header)
+		return
+	}
+
+	// HEAD响应不输出内容，无需压缩
+	if ctx.IsHead() {
+		response.ResetBody()
+		response.Header.SetContentLength(-1)
+		syncHeader(response, header)
+		return
+	}
+
+	var buffer bytes.Buffer
+	level := negotiation.CompressionLevel()
+	writer := h.getBrotliWriter(level)
+	writer.Reset(&buffer)
+	_, err := writer.Write(body)
+	if err == nil {
+		err = writer.Close()
+	}
+	h.putBrotliWriter(level, writer)
+	if err != nil {
+		return
+	}
+
+	response.SetBodyRaw(buffer.Bytes())
+	syncHeader(response, header)
+}
+
+// compressStream compresses a body set by SetBodyStream as it's read,
+// the beginning of the body is read first for ResponseFilter
+func (h *Handler) compressStream(ctx *fasthttp.RequestCtx, negotiation *brotli.Negotiation, body *stream) {
+	response := &ctx.Response
+	declared := response.Header.ContentLength()
+	length := int64(declared)
+	if length < 0 {
+		declared, length = -1, -1
+	}
+
+	prefix := make([]byte, negotiation.MinContentLength()+1)
+	n, err := io.ReadFull(body.reader, prefix)
+	prefix = prefix[:n]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		length = int64(n)
+	}
+
+	header := convertResponseHeader(&response.Header)
+	ok := negotiation.Decide(response.StatusCode(), header, prefix, length)
+
+	// 接管原始流，重置响应时不再关闭
+	body.takenOver = true
+	rest := io.MultiReader(bytes.NewReader(prefix), body.reader)
+	switch {
+	case !ok:
+		response.SetBodyStream(&readCloser{Reader: rest, closer: body.reader}, declared)
+	case ctx.IsHead():
+		// HEAD响应不输出内容，无需压缩
+		response.ResetBody()
+		closeReader(body.reader)
+		response.Header.SetContentLength(-1)
+	default:
+		level := negotiation.CompressionLevel()
+		response.SetBodyStreamWriter(func(w *bufio.Writer) {
+			h.encodeStream(level, w, rest)
+			closeReader(body.reader)
+		})
+	}
+	syncHeader(response, header)
+}
+
+// encodeStream writes src to w encoded with brotli,
+// flushing each chunk read from src
+func (h *Handler) encodeStream(level int, w *bufio.Writer, src io.Reader) {
+	writer := h.getBrotliWriter(level)
+	writer.Reset(w)
+	defer h.putBrotliWriter(level, writer)
+
+	if _, err := io.Copy(&flushWriter{writer: writer, w: w}, src); err != nil {
+		return
+	}
+	if err := writer.Close(); err == nil {
+		_ = w.Flush()
+	}
+}
+
+// getBrotliWriter 获取一个brotli writer
+func (h *Handler) getBrotliWriter(level int) *abbrotli.Writer {
+	return h.brotliWriterPools[level].Get().(*abbrotli.Writer)
+}
+
+// putBrotliWriter 回收brotli writer
+func (h *Handler) putBrotliWriter(level int, w *abbrotli.Writer) {
+	w.Reset(ioutil.Discard)
+	h.brotliWriterPools[level].Put(w)
+}
+
+// stream is a body set by SetBodyStream
+type stream struct {
+	reader io.Reader
+	// 已被Middleware接管，关闭由接管方负责
+	takenOver bool
+	closed    bool
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+// Close closes the underlying reader once unless it's taken over,
+// fasthttp closes both the body stream and user values
+func (s *stream) Close() error {
+	if s.takenOver || s.closed {
+		return nil
+	}
+	s.closed = true
+	return closeReader(s.reader)
+}
+
+// readCloser reads from Reader and closes closer
+type readCloser struct {
+	io.Reader
+	closer io.Reader
+}
+
+func (r *readCloser) Close() error {
+	return closeReader(r.closer)
+}
+
+// flushWriter flushes each write through to the connection
+type flushWriter struct {
+	writer *abbrotli.Writer
+	w      *bufio.Writer
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err = f.writer.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
+
+// closeReader closes r if it's an io.Closer
+func closeReader(r io.Reader) error {
+	if closer, ok := r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// syncHeader copies headers Negotiation.Decide updates back to response
+func syncHeader(response *fasthttp.Response, header http.Header) {
+	for _, key := range []string{"Content-Encoding", "Vary", "ETag", "Accept-Ranges"} {
+		response.Header.Del(key)
+		for _, value := range header.Values(key) {
+			response.Header.Add(key, value)
+		}
+	}
+}
+
+// convertRequest builds the *http.Request filters look at
+func convertRequest(ctx *fasthttp.RequestCtx) (*http.Request, error) {
+	req, err := http.NewRequest(string(ctx.Method()), string(ctx.RequestURI()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Host = string(ctx.Host())
+	req.RequestURI = string(ctx.RequestURI())
+	req.RemoteAddr = ctx.RemoteAddr().String()
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		req.Header.Add(string(key), string(value))
+	})
+	return req.WithContext(ctx), nil
+}
+
+// convertResponseHeader copies header into http.Header
+func convertResponseHeader(header *fasthttp.ResponseHeader) http.Header {
+	result := make(http.Header)
+	header.VisitAll(func(key, value []byte) {
+		result.Add(string(key), string(value))
+	})
+	return result
+}
@@ -0,0 +1,254 @@
+package brotlifasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/CodeLineage/brotli"
+	abbrotli "github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+var payload = bytes.Repeat([]byte(`{"code":0,"msg":"success"},`), 100)
+
+// newClient serves handler on an in-memory listener
+func newClient(t *testing.T, handler fasthttp.RequestHandler) *fasthttp.Client {
+	listener := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		_ = fasthttp.Serve(listener, handler)
+	}()
+
+	return &fasthttp.Client{
+		Dial: func(addr string) (net.Conn, error) {
+			return listener.Dial()
+		},
+	}
+}
+
+func newHandler(t *testing.T, config brotli.Config) *fasthttp.Client {
+	return serveHandler(t, brotli.NewHandler(config))
+}
+
+func serveHandler(t *testing.T, handler *brotli.Handler) *fasthttp.Client {
+	h := New(handler)
+	return newClient(t, h.Middleware(func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/":
+			ctx.SetContentType("application/json")
+			ctx.Response.Header.Set("ETag", `"abc"`)
+			ctx.SetBody(payload)
+		case "/small":
+			ctx.SetContentType("application/json")
+			ctx.SetBody([]byte(`{"code":0}`))
+		case "/png":
+			ctx.SetContentType("application/octet-stream")
+			ctx.SetBody(append([]byte("\x89PNG\r\n\x1a\n"), payload...))
+		case "/stream":
+			ctx.SetContentType("text/plain")
+			SetBodyStreamWriter(ctx, func(w *bufio.Writer) {
+				for i := 0; i < 10; i++ {
+					_, _ = w.Write(payload)
+					_ = w.Flush()
+				}
+			})
+		case "/stream/png":
+			ctx.SetContentType("application/octet-stream")
+			SetBodyStream(ctx, bytes.NewReader(append([]byte("\x89PNG\r\n\x1a\n"), payload...)), -1)
+		case "/stream/direct":
+			ctx.SetContentType("text/plain")
+			ctx.SetBodyStream(bytes.NewReader(payload), len(payload))
+		case "/wasm":
+			ctx.SetContentType("application/wasm")
+			SetBodyStream(ctx, bytes.NewReader(payload), len(payload))
+		case "/encoded":
+			ctx.SetContentType("application/json")
+			ctx.Response.Header.Set("Content-Encoding", "gzip")
+			ctx.SetBody(payload)
+		case "/error":
+			ctx.SetContentType("application/json")
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBody(payload)
+		case "/conditional":
+			ctx.SetBodyString(string(ctx.Request.Header.Peek("If-None-Match")))
+		case "/precondition":
+			ctx.Response.Header.Set("ETag", `"abc"`)
+			if string(ctx.Request.Header.Peek("If-Match")) != `"abc"` {
+				ctx.SetStatusCode(fasthttp.StatusPreconditionFailed)
+			}
+		}
+	}))
+}
+
+func doRequest(t *testing.T, client *fasthttp.Client, path string, header map[string]string) *fasthttp.Response {
+	return doMethod(t, client, fasthttp.MethodGet, path, header)
+}
+
+func doMethod(t *testing.T, client *fasthttp.Client, method, path string, header map[string]string) *fasthttp.Response {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(method)
+	req.SetRequestURI("http://localhost" + path)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp := new(fasthttp.Response)
+	require.NoError(t, client.Do(req, resp))
+	return resp
+}
+
+func decode(t *testing.T, body []byte) []byte {
+	result, err := ioutil.ReadAll(abbrotli.NewReader(bytes.NewReader(body)))
+	require.NoError(t, err)
+	return result
+}
+
+func TestMiddleware(t *testing.T) {
+	client := newHandler(t, brotli.Config{
+		RequestFilter:        []brotli.RequestFilter{brotli.NewCommonRequestFilter()},
+		ResponseHeaderFilter: []brotli.ResponseHeaderFilter{brotli.DefaultContentTypeFilter()},
+	})
+
+	resp := doRequest(t, client, "/", map[string]string{"Accept-Encoding": "br"})
+	require.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	require.Equal(t, "br", string(resp.Header.Peek("Content-Encoding")))
+	assert.Equal(t, "Accept-Encoding", string(resp.Header.Peek("Vary")))
+	assert.Equal(t, `W/"abc"`, string(resp.Header.Peek("ETag")))
+	assert.Less(t, len(resp.Body()), len(payload))
+	assert.Equal(t, payload, decode(t, resp.Body()))
+}
+
+func TestMiddleware_Update(t *testing.T) {
+	handler := brotli.NewHandler(brotli.Config{CompressionLevel: brotli.BestCompression})
+	client := serveHandler(t, handler)
+
+	resp := doRequest(t, client, "/", map[string]string{"Accept-Encoding": "br"})
+	require.Equal(t, "br", string(resp.Header.Peek("Content-Encoding")))
+
+	require.NoError(t, handler.Update(brotli.Config{
+		CompressionLevel: brotli.BestSpeed,
+		RequestFilter: []brotli.RequestFilter{
+			brotli.NewRequestApiExcludeFilter([]string{"/"}),
+		},
+	}))
+	resp = doRequest(t, client, "/", map[string]string{"Accept-Encoding": "br"})
+	assert.Empty(t, resp.Header.Peek("Content-Encoding"))
+	assert.Equal(t, payload, resp.Body())
+
+	resp = doRequest(t, client, "/stream", map[string]string{"Accept-Encoding": "br"})
+	require.Equal(t, "br", string(resp.Header.Peek("Content-Encoding")))
+	assert.Equal(t, bytes.Repeat(payload, 10), decode(t, resp.Body()))
+}
+
+func TestMiddleware_Stream(t *testing.T) {
+	client := newHandler(t, brotli.Config{
+		RequestFilter: []brotli.RequestFilter{brotli.NewCommonRequestFilter()},
+	})
+
+	resp := doRequest(t, client, "/stream", map[string]string{"Accept-Encoding": "gzip, br"})
+	require.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	require.Equal(t, "br", string(resp.Header.Peek("Content-Encoding")))
+	assert.Equal(t, "Accept-Encoding", string(resp.Header.Peek("Vary")))
+	assert.Equal(t, bytes.Repeat(payload, 10), decode(t, resp.Body()))
+
+	// gzip only clients are left alone
+	resp = doRequest(t, client, "/stream", map[string]string{"Accept-Encoding": "gzip"})
+	assert.Empty(t, resp.Header.Peek("Content-Encoding"))
+	assert.Equal(t, bytes.Repeat(payload, 10), resp.Body())
+
+	// streams set on ctx directly can't be taken over
+	resp = doRequest(t, client, "/stream/direct", map[string]string{"Accept-Encoding": "br"})
+	assert.Empty(t, resp.Header.Peek("Content-Encoding"))
+	assert.Equal(t, payload, resp.Body())
+}
+
+func TestMiddleware_StreamFilters(t *testing.T) {
+	client := newHandler(t, brotli.Config{
+		RequestFilter: []brotli.RequestFilter{brotli.NewCommonRequestFilter()},
+		ResponseHeaderFilter: []brotli.ResponseHeaderFilter{
+			brotli.NewContentTypeFilter([]string{"application/wasm", "application/octet-stream"}),
+		},
+		ResponseFilter: []brotli.ResponseFilter{brotli.NewMagicBytesFilter()},
+	})
+
+	// Buffered holds the beginning of the stream
+	resp := doRequest(t, client, "/stream/png", map[string]string{"Accept-Encoding": "br"})
+	assert.Empty(t, resp.Header.Peek("Content-Encoding"))
+	assert.Equal(t, append([]byte("\x89PNG\r\n\x1a\n"), payload...), resp.Body())
+
+	// configured Content-Type is all that matters
+	resp = doRequest(t, client, "/wasm", map[string]string{"Accept-Encoding": "br"})
+	require.Equal(t, "br", string(resp.Header.Peek("Content-Encoding")))
+	assert.Equal(t, payload, decode(t, resp.Body()))
+}
+
+func TestMiddleware_Head(t *testing.T) {
+	client := newHandler(t, brotli.Config{
+		NegotiateHead: true,
+		RequestFilter: []brotli.RequestFilter{brotli.NewCommonRequestFilter()},
+	})
+
+	for _, path := range []string{"/", "/stream"} {
+		resp := doMethod(t, client, fasthttp.MethodHead, path, map[string]string{"Accept-Encoding": "br"})
+		assert.Equal(t, "br", string(resp.Header.Peek("Content-Encoding")), path)
+		assert.Equal(t, "Accept-Encoding", string(resp.Header.Peek("Vary")), path)
+		assert.Less(t, resp.Header.ContentLength(), 0, path)
+		assert.Empty(t, resp.Body(), path)
+	}
+}
+
+func TestMiddleware_Identity(t *testing.T) {
+	client := newHandler(t, brotli.Config{
+		RequestFilter:  []brotli.RequestFilter{brotli.NewCommonRequestFilter()},
+		ResponseFilter: []brotli.ResponseFilter{brotli.NewMagicBytesFilter()},
+	})
+
+	for path, encoding := range map[string]string{
+		"/png":     "",
+		"/encoded": "gzip",
+		"/error":   "",
+	} {
+		resp := doRequest(t, client, path, map[string]string{"Accept-Encoding": "br"})
+		assert.Equal(t, encoding, string(resp.Header.Peek("Content-Encoding")), path)
+		assert.Empty(t, resp.Header.Peek("Vary"), path)
+	}
+
+	// eligible but too small
+	resp := doRequest(t, client, "/small", map[string]string{"Accept-Encoding": "br"})
+	assert.Empty(t, resp.Header.Peek("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", string(resp.Header.Peek("Vary")))
+	assert.Equal(t, `{"code":0}`, string(resp.Body()))
+
+	// br not accepted
+	resp = doRequest(t, client, "/", nil)
+	assert.Empty(t, resp.Header.Peek("Content-Encoding"))
+	assert.Equal(t, payload, resp.Body())
+}
+
+func TestMiddleware_ETagSuffix(t *testing.T) {
+	client := newHandler(t, brotli.Config{
+		ETagStrategy: brotli.ETagSuffix,
+	})
+
+	resp := doRequest(t, client, "/", nil)
+	assert.Equal(t, `"abc-br"`, string(resp.Header.Peek("ETag")))
+
+	resp = doRequest(t, client, "/conditional", map[string]string{"If-None-Match": `"abc-br", "def"`})
+	assert.Equal(t, `"abc", "def"`, string(resp.Body()))
+
+	// validators of rejected preconditions are those the client holds
+	resp = doRequest(t, client, "/precondition", map[string]string{"If-Match": `"abc-br"`})
+	assert.Equal(t, fasthttp.StatusOK, resp.StatusCode())
+	resp = doRequest(t, client, "/precondition", map[string]string{"If-Match": `"def-br"`})
+	assert.Equal(t, fasthttp.StatusPreconditionFailed, resp.StatusCode())
+	assert.Equal(t, `"abc-br"`, string(resp.Header.Peek("ETag")))
+}
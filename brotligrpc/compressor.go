@@ -0,0 +1,165 @@
+// Package brotligrpc implements a brotli compressor for gRPC, registered as
+// "br" on import.
+//
+//	import _ "github.com/CodeLineage/brotli/brotligrpc"
+//
+//	conn.Invoke(ctx, method, req, resp, grpc.UseCompressor(brotligrpc.Name))
+package brotligrpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"google.golang.org/grpc/encoding"
+)
+
+// Name is the name registered for the brotli compressor
+const Name = "br"
+
+// ErrMessageTooLarge is returned reading a message
+// decompressed beyond MaxDecompressedLength
+var ErrMessageTooLarge = errors.New("brotligrpc: decompressed message too large")
+
+// Config is used in Compressor initialization
+type Config struct {
+	// 压缩等级
+	CompressionLevel int
+	// 解压后消息长度上限，0表示不限制
+	MaxDecompressedLength int64
+}
+
+// Compressor implements encoding.Compressor with pooled
+// brotli writers and readers
+type Compressor struct {
+	compressionLevel      int
+	maxDecompressedLength int64
+	writerPool            sync.Pool
+	readerPool            sync.Pool
+}
+
+// interface verification
+var _ encoding.Compressor = (*Compressor)(nil)
+
+func init() {
+	encoding.RegisterCompressor(NewCompressor(Config{
+		CompressionLevel: brotli.DefaultCompression,
+	}))
+}
+
+// NewCompressor creates a Compressor, out of range
+// CompressionLevel is replaced with brotli.DefaultCompression
+func NewCompressor(config Config) *Compressor {
+	// 设置压缩等级不符合则，使用默认等级
+	if config.CompressionLevel < brotli.BestSpeed || config.CompressionLevel > brotli.BestCompression {
+		config.CompressionLevel = brotli.DefaultCompression
+	}
+
+	c := Compressor{
+		compressionLevel:      config.CompressionLevel,
+		maxDecompressedLength: config.MaxDecompressedLength,
+	}
+	c.writerPool.New = func() interface{} {
+		return &writer{
+			Writer: brotli.NewWriterLevel(ioutil.Discard, c.compressionLevel),
+			pool:   &c.writerPool,
+		}
+	}
+	c.readerPool.New = func() interface{} {
+		return &reader{
+			Reader: brotli.NewReader(nil),
+			pool:   &c.readerPool,
+		}
+	}
+	return &c
+}
+
+// Register replaces the registered brotli compressor with one created from config.
+// NOTE: like encoding.RegisterCompressor, it must only be called during
+// initialization time and is not thread-safe.
+func Register(config Config) error {
+	if config.CompressionLevel < brotli.BestSpeed || config.CompressionLevel > brotli.BestCompression {
+		return fmt.Errorf("brotligrpc: invalid compression level: %d", config.CompressionLevel)
+	}
+	if config.MaxDecompressedLength < 0 {
+		return fmt.Errorf("brotligrpc: invalid max decompressed length: %d", config.MaxDecompressedLength)
+	}
+
+	encoding.RegisterCompressor(NewCompressor(config))
+	return nil
+}
+
+// Name implements encoding.Compressor interface
+func (c *Compressor) Name() string {
+	return Name
+}
+
+// Compress implements encoding.Compressor interface
+func (c *Compressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	z := c.writerPool.Get().(*writer)
+	z.Writer.Reset(w)
+	return z, nil
+}
+
+// Decompress implements encoding.Compressor interface
+func (c *Compressor) Decompress(r io.Reader) (io.Reader, error) {
+	z := c.readerPool.Get().(*reader)
+	if err := z.Reader.Reset(r); err != nil {
+		c.readerPool.Put(z)
+		return nil, err
+	}
+	z.remaining = c.maxDecompressedLength
+	z.limited = c.maxDecompressedLength > 0
+	return z, nil
+}
+
+// writer returns itself to pool once closed
+type writer struct {
+	*brotli.Writer
+	pool *sync.Pool
+}
+
+// Close implements io.Closer interface
+func (z *writer) Close() error {
+	defer z.pool.Put(z)
+	return z.Writer.Close()
+}
+
+// reader returns itself to pool at the end of message,
+// failing once more than remaining bytes are decompressed
+type reader struct {
+	*brotli.Reader
+	pool      *sync.Pool
+	limited   bool
+	remaining int64
+}
+
+// Read implements io.Reader interface
+func (z *reader) Read(p []byte) (int, error) {
+	if z.limited && int64(len(p)) > z.remaining {
+		// 多读一个字节以判断是否超出上限，remaining小于len(p)时加一不会溢出
+		p = p[:z.remaining+1]
+	}
+
+	n, err := z.Reader.Read(p)
+	if z.limited {
+		if int64(n) > z.remaining {
+			z.release()
+			return int(z.remaining), ErrMessageTooLarge
+		}
+		z.remaining -= int64(n)
+	}
+	if err == io.EOF {
+		z.release()
+	}
+	return n, err
+}
+
+// release resets z and puts it back to pool
+func (z *reader) release() {
+	_ = z.Reader.Reset(nil)
+	z.pool.Put(z)
+}
@@ -0,0 +1,171 @@
+package brotligrpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var payload = bytes.Repeat([]byte(`{"code":0,"msg":"success"},`), 1000)
+
+type testServer struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+// UnaryCall echoes request payload
+func (s *testServer) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	return &testpb.SimpleResponse{Payload: req.Payload}, nil
+}
+
+// countingCompressor counts compressed and decompressed messages
+type countingCompressor struct {
+	*Compressor
+	compressed   int32
+	decompressed int32
+}
+
+func (c *countingCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	atomic.AddInt32(&c.compressed, 1)
+	return c.Compressor.Compress(w)
+}
+
+func (c *countingCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	atomic.AddInt32(&c.decompressed, 1)
+	return c.Compressor.Decompress(r)
+}
+
+// newClient serves testServer on an in-memory listener
+func newClient(t *testing.T) testpb.TestServiceClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	testpb.RegisterTestServiceServer(server, &testServer{})
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+		server.Stop()
+	})
+
+	return testpb.NewTestServiceClient(conn)
+}
+
+// registerCompressor registers c for the test, restoring default afterwards
+func registerCompressor(t *testing.T, c encoding.Compressor) {
+	encoding.RegisterCompressor(c)
+	t.Cleanup(func() {
+		encoding.RegisterCompressor(NewCompressor(Config{
+			CompressionLevel: brotli.DefaultCompression,
+		}))
+	})
+}
+
+func TestCompressor(t *testing.T) {
+	var c = NewCompressor(Config{CompressionLevel: 5})
+
+	for i := 0; i < 3; i++ {
+		var buffer bytes.Buffer
+		w, err := c.Compress(&buffer)
+		require.NoError(t, err)
+		_, err = w.Write(payload)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		assert.Less(t, buffer.Len(), len(payload))
+
+		r, err := c.Decompress(&buffer)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, payload, body)
+	}
+}
+
+func TestCompressor_MaxDecompressedLength(t *testing.T) {
+	var buffer bytes.Buffer
+	w := brotli.NewWriter(&buffer)
+	_, _ = w.Write(payload)
+	_ = w.Close()
+	compressed := buffer.Bytes()
+
+	for length, expected := range map[int64]error{
+		int64(len(payload)) - 1: ErrMessageTooLarge,
+		int64(len(payload)):     nil,
+		0:                       nil,
+		math.MaxInt64:           nil,
+	} {
+		c := NewCompressor(Config{MaxDecompressedLength: length})
+		r, err := c.Decompress(bytes.NewReader(compressed))
+		require.NoError(t, err)
+
+		body, err := ioutil.ReadAll(r)
+		assert.Equal(t, expected, err, length)
+		if expected == nil {
+			assert.Equal(t, payload, body, length)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	registerCompressor(t, encoding.GetCompressor(Name))
+
+	assert.Error(t, Register(Config{CompressionLevel: -1}))
+	assert.Error(t, Register(Config{CompressionLevel: 5, MaxDecompressedLength: -1}))
+	assert.NoError(t, Register(Config{CompressionLevel: 5}))
+	assert.Equal(t, Name, encoding.GetCompressor(Name).Name())
+}
+
+func TestUseCompressor(t *testing.T) {
+	var c = &countingCompressor{Compressor: NewCompressor(Config{})}
+	registerCompressor(t, c)
+	client := newClient(t)
+
+	resp, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{
+		Payload: &testpb.Payload{Body: payload},
+	}, grpc.UseCompressor(Name))
+	require.NoError(t, err)
+	assert.Equal(t, payload, resp.Payload.Body)
+
+	// request and response are both compressed
+	assert.EqualValues(t, 2, atomic.LoadInt32(&c.compressed))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&c.decompressed))
+}
+
+func TestUseCompressor_MaxDecompressedLength(t *testing.T) {
+	registerCompressor(t, NewCompressor(Config{MaxDecompressedLength: 1024}))
+	client := newClient(t)
+
+	_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{
+		Payload: &testpb.Payload{Body: payload},
+	}, grpc.UseCompressor(Name))
+	require.Error(t, err)
+	assert.NotEqual(t, codes.OK, status.Code(err))
+
+	// small messages pass
+	resp, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{
+		Payload: &testpb.Payload{Body: payload[:100]},
+	}, grpc.UseCompressor(Name))
+	require.NoError(t, err)
+	assert.Equal(t, payload[:100], resp.Payload.Body)
+}
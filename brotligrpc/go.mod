@@ -0,0 +1,9 @@
+module github.com/CodeLineage/brotli/brotligrpc
+
+go 1.15
+
+require (
+	github.com/andybalholm/brotli v1.0.2
+	github.com/stretchr/testify v1.5.1
+	google.golang.org/grpc v1.34.0
+)
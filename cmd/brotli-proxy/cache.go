@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCachedBody is the longest body kept in cache
+const maxCachedBody = 1 << 20
+
+// cache keeps the latest cacheable 200 responses to GET requests in
+// memory, per URL and Accept-Encoding, for their freshness lifetime
+// but at most ttl
+type cache struct {
+	entries int
+	ttl     time.Duration
+	metrics *metrics
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+// cacheEntry is a response sent to client
+type cacheEntry struct {
+	key     string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newCache(entries int, ttl time.Duration, stats *metrics) *cache {
+	return &cache{
+		entries: entries,
+		ttl:     ttl,
+		metrics: stats,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element, entries),
+	}
+}
+
+// serve wraps next, answering from cache when possible
+func (c *cache) serve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !cacheableRequest(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		key := req.URL.RequestURI() + "\n" + req.Header.Get("Accept-Encoding")
+		if entry := c.get(key); entry != nil {
+			atomic.AddInt64(&c.metrics.CacheHits, 1)
+			for k, v := range entry.header {
+				w.Header()[k] = append([]string(nil), v...)
+			}
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(entry.body)
+			return
+		}
+
+		writer := &cacheWriter{ResponseWriter: w}
+		next.ServeHTTP(writer, req)
+		now := time.Now()
+		if lifetime := writer.lifetime(c.ttl, now); lifetime > 0 {
+			c.put(&cacheEntry{
+				key:     key,
+				header:  writer.header,
+				body:    writer.body.Bytes(),
+				expires: now.Add(lifetime),
+			})
+		}
+	})
+}
+
+// get returns the entry of key unless it's missing or expired
+func (c *cache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.items, key)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+// put adds entry, evicting the least recently used one when full
+func (c *cache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[entry.key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.items[entry.key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.entries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheableRequest reports whether responses to req may be shared,
+// requests with credentials are always sent upstream
+func cacheableRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet && req.Header.Get("Authorization") == "" &&
+		req.Header.Get("Cookie") == "" && req.Header.Get("Range") == "" &&
+		req.Header.Get("Upgrade") == "" &&
+		!strings.Contains(strings.ToLower(req.Header.Get("Cache-Control")), "no-cache")
+}
+
+// cacheWriter copies the response it writes for cache
+type cacheWriter struct {
+	http.ResponseWriter
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+	// 响应过长或连接被接管时不缓存
+	skip bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (c *cacheWriter) WriteHeader(code int) {
+	if c.statusCode == 0 {
+		c.statusCode = code
+		c.header = c.Header().Clone()
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (c *cacheWriter) Write(data []byte) (int, error) {
+	if c.statusCode == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	n, err := c.ResponseWriter.Write(data)
+	if err != nil || c.body.Len()+n > maxCachedBody {
+		c.skip = true
+	}
+	if !c.skip {
+		c.body.Write(data[:n])
+	}
+	return n, err
+}
+
+// Flush implements the http.Flusher interface.
+func (c *cacheWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface.
+func (c *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying ResponseWriter does not implement http.Hijacker")
+	}
+	c.skip = true
+	return hijacker.Hijack()
+}
+
+// lifetime returns how long the written response may be shared, at most
+// ttl, 0 if it's not cacheable. Responses must be marked public or carry
+// their freshness lifetime, heuristic freshness is not used
+func (c *cacheWriter) lifetime(ttl time.Duration, now time.Time) time.Duration {
+	if c.skip || c.statusCode != http.StatusOK || c.header.Get("Set-Cookie") != "" ||
+		c.header.Get("Trailer") != "" {
+		return 0
+	}
+	// 仅按Accept-Encoding区分
+	for _, vary := range c.header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+				return 0
+			}
+		}
+	}
+
+	directives := cacheControl(c.header)
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0
+		}
+	}
+
+	// 新鲜度依次取s-maxage、max-age及Expires
+	freshness, explicit := time.Duration(0), true
+	if value, ok := directives["s-maxage"]; ok {
+		freshness = parseSeconds(value)
+	} else if value, ok := directives["max-age"]; ok {
+		freshness = parseSeconds(value)
+	} else if expires := c.header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			date := now
+			if d, err := http.ParseTime(c.header.Get("Date")); err == nil {
+				date = d
+			}
+			freshness = t.Sub(date)
+		}
+	} else if _, ok := directives["public"]; ok {
+		freshness, explicit = ttl, false
+	} else {
+		return 0
+	}
+	if explicit {
+		// 减去响应已在上游缓存中的时间
+		freshness -= parseSeconds(c.header.Get("Age"))
+	}
+
+	if freshness > ttl {
+		freshness = ttl
+	}
+	if freshness < 0 {
+		return 0
+	}
+	return freshness
+}
+
+// cacheControl parses Cache-Control of header into lower case
+// directives and their unquoted values
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = value
+			}
+		}
+	}
+	return directives
+}
+
+// parseSeconds parses delta-seconds, invalid values are 0
+func parseSeconds(value string) time.Duration {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	if seconds > int64(math.MaxInt64/time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,121 @@
+// Command brotli-proxy is a reverse proxy compressing responses of
+// an upstream service with brotli according to a JSON or YAML config file,
+// compressed responses may be cached in memory.
+//
+//	brotli-proxy -config brotli-proxy.yaml
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/CodeLineage/brotli"
+)
+
+// config is read from the config file
+type config struct {
+	// 压缩配置
+	brotli.Spec `yaml:",inline"`
+	// 监听地址
+	Listen string `json:"listen" yaml:"listen" env:"LISTEN"`
+	// 上游服务地址
+	Upstream string `json:"upstream" yaml:"upstream" env:"UPSTREAM"`
+	// 指标路径，为空则不提供
+	MetricsPath string `json:"metrics_path" yaml:"metrics_path" env:"METRICS_PATH"`
+	// 缓存的响应数，为0则不缓存
+	CacheEntries int `json:"cache_entries" yaml:"cache_entries" env:"CACHE_ENTRIES"`
+	// 缓存有效期，如30s，为空则为1m
+	CacheTTL string `json:"cache_ttl" yaml:"cache_ttl" env:"CACHE_TTL"`
+}
+
+// loadConfig reads config from a JSON or YAML file at path,
+// every option may be overridden by BROTLI_ environment variables
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := config{Listen: ":8080"}
+	if err := brotli.UnmarshalSpec(data, filepath.Ext(path), &cfg); err != nil {
+		return nil, err
+	}
+	if err := brotli.ApplyEnv("BROTLI_", &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Upstream == "" {
+		return nil, errors.New("upstream is required")
+	}
+	return &cfg, nil
+}
+
+// newServer builds the proxy serving cfg
+func newServer(cfg *config) (http.Handler, error) {
+	target, err := url.Parse(cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, errors.New("upstream must be an absolute URL")
+	}
+
+	if cfg.CacheEntries < 0 {
+		return nil, errors.New("cache_entries must not be negative")
+	}
+	ttl := time.Minute
+	if cfg.CacheTTL != "" {
+		if ttl, err = time.ParseDuration(cfg.CacheTTL); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("cache_ttl must be a positive duration: %q", cfg.CacheTTL)
+		}
+	}
+
+	compressor, err := brotli.NewHandlerFromSpec(cfg.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		stats = &metrics{}
+		proxy = httputil.NewSingleHostReverseProxy(target)
+	)
+	proxy.ModifyResponse = stats.countUpstream
+	handler := compressor.ReverseProxy(proxy)
+	if cfg.CacheEntries > 0 {
+		// 缓存压缩后的响应，命中时不再请求上游及压缩
+		handler = newCache(cfg.CacheEntries, ttl, stats).serve(handler)
+	}
+	handler = stats.count(handler)
+	if cfg.MetricsPath == "" {
+		return handler, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle(cfg.MetricsPath, stats)
+	return mux, nil
+}
+
+func main() {
+	path := flag.String("config", "brotli-proxy.json", "config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		log.Fatalf("load config: %v", err)
+	}
+	handler, err := newServer(cfg)
+	if err != nil {
+		log.Fatalf("create server: %v", err)
+	}
+
+	log.Printf("brotli-proxy listening on %s, upstream %s", cfg.Listen, cfg.Upstream)
+	log.Fatal(http.ListenAndServe(cfg.Listen, handler))
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CodeLineage/brotli"
+	abbrotli "github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var payload = bytes.Repeat([]byte(`{"code":0,"msg":"success"},`), 100)
+
+func newUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+		}
+		_, _ = w.Write(payload)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "brotli-proxy")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "brotli-proxy.json", `{"upstream": "http://127.0.0.1:3000", "level": 0}`))
+	require.NoError(t, err)
+	assert.Equal(t, ":8080", cfg.Listen)
+	require.NotNil(t, cfg.Level)
+	assert.Equal(t, 0, *cfg.Level)
+
+	cfg, err = loadConfig(writeConfig(t, "brotli-proxy.yaml", "upstream: http://127.0.0.1:3000\nlevel: 5\nexclude_paths: [/raw]\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:3000", cfg.Upstream)
+	assert.Equal(t, []string{"/raw"}, cfg.ExcludePaths)
+
+	// every option may be overridden
+	func() {
+		for name, value := range map[string]string{
+			"BROTLI_LEVEL":         "9",
+			"BROTLI_UPSTREAM":      "http://127.0.0.1:4000",
+			"BROTLI_METRICS_PATH":  "/stats",
+			"BROTLI_CACHE_ENTRIES": "100",
+			"BROTLI_CACHE_TTL":     "10s",
+		} {
+			require.NoError(t, os.Setenv(name, value))
+			defer os.Unsetenv(name)
+		}
+		cfg, err := loadConfig(writeConfig(t, "brotli-proxy.json", `{"upstream": "http://127.0.0.1:3000", "level": 0}`))
+		require.NoError(t, err)
+		assert.Equal(t, 9, *cfg.Level)
+		assert.Equal(t, "http://127.0.0.1:4000", cfg.Upstream)
+		assert.Equal(t, "/stats", cfg.MetricsPath)
+		assert.Equal(t, 100, cfg.CacheEntries)
+		assert.Equal(t, "10s", cfg.CacheTTL)
+	}()
+
+	for name, content := range map[string]string{
+		"empty.json":   `{}`,
+		"broken.json":  `{"upstream": `,
+		"unknown.json": `{"upstream": "http://127.0.0.1:3000", "compression_level": 5}`,
+		"unknown.yaml": "upstream: http://127.0.0.1:3000\ncompression_level: 5\n",
+		"config.toml":  `upstream = "http://127.0.0.1:3000"`,
+	} {
+		_, err = loadConfig(writeConfig(t, name, content))
+		assert.Error(t, err, name)
+	}
+	_, err = loadConfig(filepath.Join(os.TempDir(), "does-not-exist.json"))
+	assert.Error(t, err)
+
+	_, err = newServer(&config{Upstream: "127.0.0.1:3000"})
+	assert.Error(t, err)
+
+	level := 12
+	_, err = newServer(&config{Upstream: "http://127.0.0.1:3000", Spec: brotli.Spec{Level: &level}})
+	assert.Error(t, err)
+}
+
+func TestProxy(t *testing.T) {
+	upstream := newUpstream(t)
+	cfg, err := loadConfig(writeConfig(t, "brotli-proxy.json", `{
+		"upstream": "`+upstream.URL+`",
+		"level": 5,
+		"include_paths": ["/", "/image"],
+		"metrics_path": "/metrics"
+	}`))
+	require.NoError(t, err)
+	handler, err := newServer(cfg)
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	// the transport decodes gzip only, br is left as is
+	for path, encoding := range map[string]string{
+		"/":      "br",
+		"/image": "",
+		"/other": "",
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "br")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		var body []byte
+		if encoding == "br" {
+			body, err = ioutil.ReadAll(abbrotli.NewReader(resp.Body))
+		} else {
+			body, err = ioutil.ReadAll(resp.Body)
+		}
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, encoding, resp.Header.Get("Content-Encoding"), path)
+		assert.Equal(t, payload, body, path)
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var stats metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.EqualValues(t, 3, stats.Requests)
+	assert.EqualValues(t, 1, stats.BrResponses)
+	assert.EqualValues(t, 3*len(payload), stats.UpstreamBytes)
+	assert.Less(t, stats.SentBytes, stats.UpstreamBytes)
+}
+
+func TestProxy_Cache(t *testing.T) {
+	var hits int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		_, _ = w.Write(payload)
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler, err := newServer(&config{Upstream: upstream.URL, CacheEntries: 1, MetricsPath: "/metrics"})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	get := func(path, acceptEncoding string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+
+		var body []byte
+		if resp.Header.Get("Content-Encoding") == "br" {
+			body, err = ioutil.ReadAll(abbrotli.NewReader(resp.Body))
+		} else {
+			body, err = ioutil.ReadAll(resp.Body)
+		}
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, payload, body, path)
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := get("/", "br")
+		assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt64(&hits))
+
+	// entries differ by Accept-Encoding, the br one is evicted
+	assert.Empty(t, get("/", "identity").Header.Get("Content-Encoding"))
+	assert.Equal(t, "br", get("/", "br").Header.Get("Content-Encoding"))
+	assert.EqualValues(t, 3, atomic.LoadInt64(&hits))
+
+	get("/private", "br")
+	get("/private", "br")
+	assert.EqualValues(t, 5, atomic.LoadInt64(&hits))
+
+	resp, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var stats metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.EqualValues(t, 2, stats.CacheHits)
+	assert.EqualValues(t, 6, stats.BrResponses)
+
+	for _, cfg := range []*config{
+		{Upstream: upstream.URL, CacheEntries: -1},
+		{Upstream: upstream.URL, CacheEntries: 1, CacheTTL: "1"},
+		{Upstream: upstream.URL, CacheEntries: 1, CacheTTL: "-1s"},
+	} {
+		_, err = newServer(cfg)
+		assert.Error(t, err, cfg.CacheTTL)
+	}
+}
+
+func TestProxy_CacheSession(t *testing.T) {
+	var hits int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/me" {
+			w.Header().Set("Cache-Control", "max-age=0")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		cookie, _ := req.Cookie("session")
+		var user string
+		if cookie != nil {
+			user = cookie.Value
+		}
+		_, _ = w.Write([]byte(`{"user":"` + user + `"}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler, err := newServer(&config{Upstream: upstream.URL, CacheEntries: 10})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	get := func(path, session string) string {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// requests with cookies are never answered from cache
+	for _, path := range []string{"/me", "/profile"} {
+		assert.Equal(t, `{"user":"alice"}`, get(path, "alice"), path)
+		assert.Equal(t, `{"user":"bob"}`, get(path, "bob"), path)
+	}
+	assert.EqualValues(t, 4, atomic.LoadInt64(&hits))
+
+	// stale responses are not stored
+	get("/me", "")
+	get("/me", "")
+	assert.EqualValues(t, 6, atomic.LoadInt64(&hits))
+	get("/profile", "")
+	get("/profile", "")
+	assert.EqualValues(t, 7, atomic.LoadInt64(&hits))
+}
+
+func TestCacheWriter_Lifetime(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		header   http.Header
+		expected time.Duration
+	}{
+		{http.Header{}, 0},
+		{http.Header{"Cache-Control": {"max-age=0"}}, 0},
+		{http.Header{"Cache-Control": {"public, max-age=0"}}, 0},
+		{http.Header{"Cache-Control": {"public"}}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=30"}}, 30 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=3600"}}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=30"}, "Age": {"20"}}, 10 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=3600, s-maxage=10"}}, 10 * time.Second},
+		{http.Header{"Cache-Control": {"s-maxage=0, max-age=60"}}, 0},
+		{http.Header{"Cache-Control": {"public, max-age=60, no-cache"}}, 0},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, 0},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding, Cookie"}}, 0},
+		{http.Header{"Expires": {now.Add(20 * time.Second).Format(http.TimeFormat)}}, 20 * time.Second},
+		{http.Header{"Expires": {"0"}, "Cache-Control": {"public"}}, 0},
+		{http.Header{
+			"Expires": {now.Add(20 * time.Second).Format(http.TimeFormat)},
+			"Date":    {now.Add(-10 * time.Second).Format(http.TimeFormat)},
+		}, 30 * time.Second},
+	} {
+		writer := cacheWriter{statusCode: http.StatusOK, header: c.header}
+		assert.Equal(t, c.expected, writer.lifetime(time.Minute, now), "%v", c.header)
+	}
+}
+
+func TestCache_Expire(t *testing.T) {
+	c := newCache(2, time.Minute, &metrics{})
+	c.put(&cacheEntry{key: "a", expires: time.Now().Add(-time.Second)})
+	c.put(&cacheEntry{key: "b", expires: time.Now().Add(time.Minute)})
+	assert.Nil(t, c.get("a"))
+	assert.NotNil(t, c.get("b"))
+	assert.Equal(t, 1, c.lru.Len())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// metrics counts proxied traffic
+type metrics struct {
+	Requests      int64 `json:"requests"`
+	BrResponses   int64 `json:"br_responses"`
+	UpstreamBytes int64 `json:"upstream_bytes"`
+	SentBytes     int64 `json:"sent_bytes"`
+	CacheHits     int64 `json:"cache_hits"`
+}
+
+// ServeHTTP reports metrics as JSON
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	snapshot := metrics{
+		Requests:      atomic.LoadInt64(&m.Requests),
+		BrResponses:   atomic.LoadInt64(&m.BrResponses),
+		UpstreamBytes: atomic.LoadInt64(&m.UpstreamBytes),
+		SentBytes:     atomic.LoadInt64(&m.SentBytes),
+		CacheHits:     atomic.LoadInt64(&m.CacheHits),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(snapshot)
+}
+
+// count wraps next, counting requests and bytes sent
+func (m *metrics) count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&m.Requests, 1)
+		writer := &countingWriter{ResponseWriter: w, metrics: m}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+// countUpstream counts body bytes read from upstream
+func (m *metrics) countUpstream(resp *http.Response) error {
+	if resp.Body != nil {
+		resp.Body = &countingBody{ReadCloser: resp.Body, metrics: m}
+	}
+	return nil
+}
+
+// countingWriter counts bytes written to client
+type countingWriter struct {
+	http.ResponseWriter
+	metrics     *metrics
+	wroteHeader bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (c *countingWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		if c.Header().Get("Content-Encoding") == "br" {
+			atomic.AddInt64(&c.metrics.BrResponses, 1)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (c *countingWriter) Write(data []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	n, err := c.ResponseWriter.Write(data)
+	atomic.AddInt64(&c.metrics.SentBytes, int64(n))
+	return n, err
+}
+
+// Flush implements the http.Flusher interface.
+func (c *countingWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface.
+func (c *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying ResponseWriter does not implement http.Hijacker")
+	}
+	return hijacker.Hijack()
+}
+
+// countingBody counts bytes read from upstream
+type countingBody struct {
+	io.ReadCloser
+	metrics *metrics
+}
+
+// Read implements io.Reader interface
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.metrics.UpstreamBytes, int64(n))
+	return n, err
+}
@@ -0,0 +1,101 @@
+package brotli
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// readerPools holds decoders for decodedBody
+type readerPools struct {
+	brotli sync.Pool
+	gzip   sync.Pool
+}
+
+// decodedBody decodes body with a pooled reader created on first Read,
+// failing once more than remaining bytes are decoded
+type decodedBody struct {
+	pools     *readerPools
+	body      io.ReadCloser
+	encoding  string
+	reader    io.Reader
+	limited   bool
+	remaining int64
+	err       error
+}
+
+// Read implements io.Reader interface
+func (d *decodedBody) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.reader == nil {
+		if d.err = d.initReader(); d.err != nil {
+			return 0, d.err
+		}
+	}
+
+	if d.limited && int64(len(p)) > d.remaining {
+		// 多读一个字节以判断是否超出上限，remaining小于len(p)时加一不会溢出
+		p = p[:d.remaining+1]
+	}
+
+	n, err := d.reader.Read(p)
+	if d.limited {
+		if int64(n) > d.remaining {
+			d.err = ErrDecodedBodyTooLarge
+			return int(d.remaining), d.err
+		}
+		d.remaining -= int64(n)
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// initReader takes a reader from pool
+func (d *decodedBody) initReader() error {
+	switch d.encoding {
+	case "br":
+		reader, _ := d.pools.brotli.Get().(*brotli.Reader)
+		if reader == nil {
+			reader = brotli.NewReader(d.body)
+		} else if err := reader.Reset(d.body); err != nil {
+			d.pools.brotli.Put(reader)
+			return err
+		}
+		d.reader = reader
+	default:
+		reader, _ := d.pools.gzip.Get().(*gzip.Reader)
+		if reader == nil {
+			var err error
+			if reader, err = gzip.NewReader(d.body); err != nil {
+				return err
+			}
+		} else if err := reader.Reset(d.body); err != nil {
+			d.pools.gzip.Put(reader)
+			return err
+		}
+		d.reader = reader
+	}
+	return nil
+}
+
+// Close puts reader back to pool and closes body
+func (d *decodedBody) Close() error {
+	switch reader := d.reader.(type) {
+	case *brotli.Reader:
+		d.pools.brotli.Put(reader)
+	case *gzip.Reader:
+		d.pools.gzip.Put(reader)
+	}
+	d.reader = nil
+	if d.err == nil {
+		d.err = errors.New("brotli: read on closed response body")
+	}
+	return d.body.Close()
+}
@@ -0,0 +1,41 @@
+package brotli
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// Content-Digest algorithms
+//
+// https://www.rfc-editor.org/rfc/rfc9530#section-5
+const (
+	DigestSHA256 = "sha-256"
+	DigestSHA512 = "sha-512"
+)
+
+// newDigestHash returns hash for algorithm, nil if it's unknown
+func newDigestHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case DigestSHA256:
+		return sha256.New()
+	case DigestSHA512:
+		return sha512.New()
+	default:
+		return nil
+	}
+}
+
+// setContentDigest sets Content-Digest of sum in header,
+// legacy Digest is set as well if asked.
+func setContentDigest(header http.Header, algorithm string, sum []byte, legacy bool) {
+	encoded := base64.StdEncoding.EncodeToString(sum)
+	header.Set("Content-Digest", algorithm+"=:"+encoded+":")
+	if legacy {
+		// https://tools.ietf.org/html/rfc3230#section-4.3.2
+		header.Set("Digest", strings.ToUpper(algorithm)+"="+encoded)
+	}
+}
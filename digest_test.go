@@ -0,0 +1,75 @@
+package brotli
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGinWithContentDigest(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		algorithm         string
+		bufferedMaxLength int64
+		acceptEncoding    string
+	}{
+		{"trailer", DigestSHA256, 0, "br"},
+		{"buffered", DigestSHA512, int64(len(bigPayload)), "br"},
+		{"identity", DigestSHA256, 0, ""},
+	} {
+		var (
+			g = newGinInstance(bigPayload, NewHandler(Config{
+				CompressionLevel:  DefaultCompression,
+				MinContentLength:  DefalutContentLen,
+				BufferedMaxLength: tc.bufferedMaxLength,
+				ContentDigest:     tc.algorithm,
+				RequestFilter: []RequestFilter{
+					NewCommonRequestFilter(),
+				},
+			}).Gin)
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, "/digest", nil)
+		)
+		g.GET("/digest", func(ctx *gin.Context) {
+			ctx.Header("Content-Digest", "sha-256=:identity:")
+			ctx.Header("Digest", "SHA-256=identity")
+			ctx.Header("Repr-Digest", "sha-256=:identity:")
+			ctx.Data(http.StatusOK, "application/json", bigPayload)
+		})
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		body, err := ioutil.ReadAll(result.Body)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, "sha-256=:identity:", result.Header.Get("Repr-Digest"), tc.name)
+
+		switch tc.name {
+		case "trailer":
+			require.Equal(t, "br", result.Header.Get("Content-Encoding"))
+			sum := sha256.Sum256(body)
+			encoded := base64.StdEncoding.EncodeToString(sum[:])
+			assert.Equal(t, []string{"Content-Digest", "Digest"}, result.Header.Values("Trailer"))
+			assert.Equal(t, "sha-256=:"+encoded+":", result.Trailer.Get("Content-Digest"))
+			assert.Equal(t, "SHA-256="+encoded, result.Trailer.Get("Digest"))
+		case "buffered":
+			require.Equal(t, "br", result.Header.Get("Content-Encoding"))
+			sum := sha512.Sum512(body)
+			assert.Empty(t, result.Header.Get("Trailer"))
+			assert.Equal(t, "sha-512=:"+base64.StdEncoding.EncodeToString(sum[:])+":", result.Header.Get("Content-Digest"))
+		default:
+			// digests of identity content are kept
+			assert.Empty(t, result.Header.Get("Content-Encoding"))
+			assert.Equal(t, "sha-256=:identity:", result.Header.Get("Content-Digest"))
+			assert.Equal(t, "SHA-256=identity", result.Header.Get("Digest"))
+		}
+	}
+}
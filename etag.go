@@ -0,0 +1,82 @@
+package brotli
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ETagStrategy decides how ETag of compressed responses is rewritten
+type ETagStrategy int
+
+const (
+	// ETagWeaken marks strong ETag weak by prefixing W/
+	ETagWeaken ETagStrategy = iota
+	// ETagSuffix appends encoding suffix, making a distinct strong validator,
+	// suffix in If-None-Match and If-Match is removed before reaching handlers
+	ETagSuffix
+	// ETagKeep leaves ETag untouched
+	ETagKeep
+)
+
+// etagSuffix marks ETag of brotli encoded representation
+const etagSuffix = "-br"
+
+// rewriteETag of compressed response according to strategy
+func rewriteETag(header http.Header, strategy ETagStrategy) {
+	etag := header.Get("ETag")
+	if etag == "" {
+		return
+	}
+
+	switch strategy {
+	case ETagSuffix:
+		header.Set("ETag", addETagSuffix(etag))
+	case ETagKeep:
+	default:
+		if !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+	}
+}
+
+// addETagSuffix turns "abc" into "abc-br", keeping weakness,
+// malformed or already suffixed ETag is returned as is
+func addETagSuffix(etag string) string {
+	if len(etag) < 2 || etag[len(etag)-1] != '"' ||
+		strings.HasSuffix(etag, etagSuffix+`"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + etagSuffix + `"`
+}
+
+// stripConditionalETags removes etagSuffix from entity tags in
+// If-None-Match and If-Match, reporting whether any was found
+func stripConditionalETags(header http.Header) bool {
+	var stripped bool
+	for _, key := range []string{"If-None-Match", "If-Match"} {
+		values := header.Values(key)
+		for i, value := range values {
+			if result, ok := stripETagList(value); ok {
+				values[i] = result
+				stripped = true
+			}
+		}
+	}
+	return stripped
+}
+
+// stripETagList strips etagSuffix from a comma separated list of entity tags
+func stripETagList(list string) (string, bool) {
+	if !strings.Contains(list, etagSuffix+`"`) {
+		return list, false
+	}
+
+	items := strings.Split(list, ",")
+	for i, item := range items {
+		trimmed := strings.TrimSpace(item)
+		if strings.HasSuffix(trimmed, etagSuffix+`"`) {
+			items[i] = strings.Replace(item, etagSuffix+`"`, `"`, 1)
+		}
+	}
+	return strings.Join(items, ","), true
+}
@@ -0,0 +1,77 @@
+package brotli
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddETagSuffix(t *testing.T) {
+	assert.Equal(t, `"abc-br"`, addETagSuffix(`"abc"`))
+	assert.Equal(t, `W/"abc-br"`, addETagSuffix(`W/"abc"`))
+	assert.Equal(t, `"abc-br"`, addETagSuffix(`"abc-br"`))
+	assert.Equal(t, `abc`, addETagSuffix(`abc`))
+}
+
+func TestStripETagList(t *testing.T) {
+	list, ok := stripETagList(`"abc-br", W/"def-br" , "ghi"`)
+	assert.True(t, ok)
+	assert.Equal(t, `"abc", W/"def" , "ghi"`, list)
+
+	list, ok = stripETagList(`*`)
+	assert.False(t, ok)
+	assert.Equal(t, `*`, list)
+}
+
+func TestGinWithETagStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		strategy ETagStrategy
+		key      string
+		value    string
+		status   int
+		etag     string
+	}{
+		{ETagWeaken, "", "", http.StatusOK, `W/"abc"`},
+		{ETagSuffix, "", "", http.StatusOK, `"abc-br"`},
+		{ETagKeep, "", "", http.StatusOK, `"abc"`},
+		// suffix is removed before reaching handler
+		{ETagSuffix, "If-None-Match", `"abc-br"`, http.StatusNotModified, `"abc-br"`},
+		{ETagSuffix, "If-None-Match", `"xyz-br", "abc-br"`, http.StatusNotModified, `"abc-br"`},
+		{ETagSuffix, "If-None-Match", `"xyz-br"`, http.StatusOK, `"abc-br"`},
+		{ETagSuffix, "If-Match", `"abc-br"`, http.StatusOK, `"abc-br"`},
+		{ETagSuffix, "If-Match", `"xyz-br"`, http.StatusPreconditionFailed, `"abc-br"`},
+	} {
+		var (
+			g = newGinInstance(bigPayload, NewHandler(Config{
+				CompressionLevel: DefaultCompression,
+				MinContentLength: DefalutContentLen,
+				ETagStrategy:     tc.strategy,
+			}).Gin)
+			w    = httptest.NewRecorder()
+			r    = httptest.NewRequest(http.MethodGet, "/etag", nil)
+			name = tc.etag + " " + tc.key + ": " + tc.value
+		)
+		g.GET("/etag", func(ctx *gin.Context) {
+			ctx.Header("ETag", `"abc"`)
+			ctx.Header("Content-Type", "application/json")
+			http.ServeContent(ctx.Writer, ctx.Request, "", time.Time{}, bytes.NewReader(bigPayload))
+		})
+		r.Header.Set("Accept-Encoding", "br")
+		if tc.key != "" {
+			r.Header.Set(tc.key, tc.value)
+		}
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		assert.EqualValues(t, tc.status, result.StatusCode, name)
+		assert.Equal(t, tc.etag, result.Header.Get("ETag"), name)
+		if tc.status == http.StatusOK {
+			assert.Equal(t, "br", result.Header.Get("Content-Encoding"), name)
+		}
+	}
+}
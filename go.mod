@@ -3,7 +3,8 @@ module github.com/CodeLineage/brotli
 go 1.15
 
 require (
-	github.com/andybalholm/brotli v1.0.1
+	github.com/andybalholm/brotli v1.0.2
 	github.com/gin-gonic/gin v1.6.1
-	github.com/stretchr/testify v1.4.0
+	github.com/stretchr/testify v1.5.1
+	gopkg.in/yaml.v2 v2.2.8
 )
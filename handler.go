@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
@@ -22,54 +23,153 @@ const (
 type Config struct {
 	// 压缩等级
 	CompressionLevel int
-	// 响应内容长度
+	// 响应内容长度，为0则使用DefalutContentLen
 	MinContentLength int64
+	// 声明的响应内容长度超过此值时不压缩，0表示不限制
+	MaxContentLength int64
+	// 不超过此长度的响应在内存中完成压缩并输出准确的Content-Length，
+	// 超过后自动切换为流式输出，0表示始终流式输出
+	BufferedMaxLength int64
+	// 压缩后ETag的处理方式，默认弱化为W/
+	ETagStrategy ETagStrategy
+	// HEAD请求按对应GET请求协商，输出相同的Content-Encoding、Vary、ETag，
+	// 但不执行压缩
+	NegotiateHead bool
+	// 对压缩后内容计算摘要，DigestSHA256或DigestSHA512，流式输出时以trailer发送，
+	// 为空则不计算
+	ContentDigest string
+	// 以trailer输出压缩前长度、压缩率及Server-Timing，
+	// 内存压缩模式下以header输出
+	CompressionTrailers bool
+	// 通过Server-Timing输出压缩耗时及压缩率，与handler设置的条目合并，
+	// 流式输出时以trailer发送
+	ServerTiming bool
+	// 压缩的响应状态码，为空则仅压缩200，206始终不压缩
+	StatusCodes []int
+	// ReverseProxy收到gzip编码的上游响应时，若客户端接受br则解码后以brotli重新压缩
+	TranscodeGzip bool
+	// 提取请求匹配的路由模板，供RequestApiFilter等按路由而非原始路径匹配，
+	// 为空时Gin使用FullPath
+	RoutePattern func(req *http.Request) string
 	// 根据请求校验是否过滤
 	RequestFilter []RequestFilter
 	// 根据响应校验是否过滤
 	ResponseHeaderFilter []ResponseHeaderFilter
+	// 根据响应上下文校验是否过滤，在缓冲区满时执行
+	ResponseFilter []ResponseFilter
 }
 
 // Handler implement brotli compression for gin
+//
+// Its configuration may be replaced at runtime by Update
 type Handler struct {
+	// 当前配置，*handlerState
+	state       atomic.Value
+	updateMutex sync.Mutex
+	gzipReaders readerPools
+}
+
+// handlerState is a configuration of Handler with the pools built for it,
+// responses keep the state they started with until they are done
+type handlerState struct {
 	compressionLevel     int
 	minContentLength     int64
+	maxContentLength     int64
+	bufferedMaxLength    int64
+	etagStrategy         ETagStrategy
+	negotiateHead        bool
+	contentDigest        string
+	compressionTrailers  bool
+	serverTiming         bool
+	statusCodes          []int
+	transcodeGzip        bool
+	routePattern         func(req *http.Request) string
 	requestFilter        []RequestFilter
 	responseHeaderFilter []ResponseHeaderFilter
-	brotliWriterPool     sync.Pool
-	wrapperPool          sync.Pool
+	responseFilter       []ResponseFilter
+	// 压缩等级不变时沿用上一状态的brotli writer
+	brotliWriterPool *sync.Pool
+	wrapperPool      sync.Pool
 }
 
+// NewHandler creates a handler, out of range CompressionLevel and
+// MinContentLength are replaced with defaults, see NewHandlerStrict
 func NewHandler(config Config) *Handler {
 	// 设置压缩等级不符合则，使用默认等级
 	if config.CompressionLevel < BestSpeed || config.CompressionLevel > BestCompression {
 		config.CompressionLevel = DefaultCompression
 	}
+
+	var handler Handler
+	handler.state.Store(newHandlerState(config, nil))
+	return &handler
+}
+
+// newHandlerState builds the state of config, reusing brotli writers
+// of previous if the compression level is unchanged
+func newHandlerState(config Config, previous *handlerState) *handlerState {
 	// 设置默认压缩长度限制
 	if config.MinContentLength <= 0 {
 		config.MinContentLength = DefalutContentLen
 	}
 
-	handler := Handler{
+	state := &handlerState{
 		compressionLevel:     config.CompressionLevel,
 		minContentLength:     config.MinContentLength,
+		maxContentLength:     config.MaxContentLength,
+		bufferedMaxLength:    config.BufferedMaxLength,
+		etagStrategy:         config.ETagStrategy,
+		negotiateHead:        config.NegotiateHead,
+		contentDigest:        config.ContentDigest,
+		compressionTrailers:  config.CompressionTrailers,
+		serverTiming:         config.ServerTiming,
+		statusCodes:          config.StatusCodes,
+		transcodeGzip:        config.TranscodeGzip,
+		routePattern:         config.RoutePattern,
 		requestFilter:        config.RequestFilter,
 		responseHeaderFilter: config.ResponseHeaderFilter,
+		responseFilter:       config.ResponseFilter,
 	}
 
 	// brotli writer
-	handler.brotliWriterPool.New = func() interface{} {
-		return brotli.NewWriterLevel(ioutil.Discard, handler.compressionLevel)
+	if previous != nil && previous.compressionLevel == state.compressionLevel {
+		state.brotliWriterPool = previous.brotliWriterPool
+	} else {
+		level := state.compressionLevel
+		state.brotliWriterPool = &sync.Pool{
+			New: func() interface{} {
+				return brotli.NewWriterLevel(ioutil.Discard, level)
+			},
+		}
 	}
-	handler.wrapperPool.New = func() interface{} {
-		return newWriterWrapper(handler.responseHeaderFilter,
-			handler.minContentLength,
+	state.wrapperPool.New = func() interface{} {
+		wrapper := newWriterWrapper(state.responseHeaderFilter,
+			state.responseFilter,
+			state.minContentLength,
+			state.maxContentLength,
+			state.bufferedMaxLength,
+			state.etagStrategy,
+			state.contentDigest,
+			state.compressionTrailers,
+			state.serverTiming,
+			state.statusCodes,
 			nil,
-			handler.getBrotliWriter,
-			handler.putBrotliWriter)
+			state.getBrotliWriter,
+			state.putBrotliWriter)
+		wrapper.state = state
+		return wrapper
 	}
 
-	return &handler
+	return state
+}
+
+// NewHandlerStrict creates a handler like NewHandler, but refuses config
+// failing Config.Validate instead of replacing invalid fields
+func NewHandlerStrict(config Config) (*Handler, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return NewHandler(config), nil
 }
 
 // 默认配置
@@ -80,6 +180,7 @@ var defaultConfig = Config{
 		NewCommonRequestFilter(),
 	},
 	ResponseHeaderFilter: []ResponseHeaderFilter{
+		NewNoTransformFilter(),
 		DefaultContentTypeFilter(),
 	},
 }
@@ -89,28 +190,69 @@ func DefaultHandler() *Handler {
 	return NewHandler(defaultConfig)
 }
 
+// Config returns the configuration h currently works with, defaults applied
+func (h *Handler) Config() Config {
+	state := h.current()
+	return Config{
+		CompressionLevel:     state.compressionLevel,
+		MinContentLength:     state.minContentLength,
+		MaxContentLength:     state.maxContentLength,
+		BufferedMaxLength:    state.bufferedMaxLength,
+		ETagStrategy:         state.etagStrategy,
+		NegotiateHead:        state.negotiateHead,
+		ContentDigest:        state.contentDigest,
+		CompressionTrailers:  state.compressionTrailers,
+		ServerTiming:         state.serverTiming,
+		StatusCodes:          state.statusCodes,
+		TranscodeGzip:        state.transcodeGzip,
+		RoutePattern:         state.routePattern,
+		RequestFilter:        state.requestFilter,
+		ResponseHeaderFilter: state.responseHeaderFilter,
+		ResponseFilter:       state.responseFilter,
+	}
+}
+
+// Update replaces the configuration of h, config failing Config.Validate
+// is refused. Requests arriving afterwards use config, responses already
+// being written finish with the configuration they started with.
+func (h *Handler) Update(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	h.updateMutex.Lock()
+	defer h.updateMutex.Unlock()
+	h.state.Store(newHandlerState(config, h.current()))
+	return nil
+}
+
+// current returns the state requests are served with
+func (h *Handler) current() *handlerState {
+	return h.state.Load().(*handlerState)
+}
+
 // getBrotliWriter 获取一个brotli writer
-func (h *Handler) getBrotliWriter() *brotli.Writer {
-	return h.brotliWriterPool.Get().(*brotli.Writer)
+func (s *handlerState) getBrotliWriter() *brotli.Writer {
+	return s.brotliWriterPool.Get().(*brotli.Writer)
 }
 
 // putBrotliWriter 回收brotli writer
-func (h *Handler) putBrotliWriter(w *brotli.Writer) {
+func (s *handlerState) putBrotliWriter(w *brotli.Writer) {
 	if w == nil {
 		return
 	}
 
 	_ = w.Close()
 	w.Reset(ioutil.Discard)
-	h.brotliWriterPool.Put(w)
+	s.brotliWriterPool.Put(w)
 }
 
 // getWriteWrapper 获取Wrapper
-func (h *Handler) getWriteWrapper() *writerWrapper {
-	return h.wrapperPool.Get().(*writerWrapper)
+func (s *handlerState) getWriteWrapper() *writerWrapper {
+	return s.wrapperPool.Get().(*writerWrapper)
 }
 
-// putWriteWrapper
+// putWriteWrapper 回收Wrapper至其所属状态
 func (h *Handler) putWriteWrapper(w *writerWrapper) {
 	if w == nil {
 		return
@@ -119,7 +261,8 @@ func (h *Handler) putWriteWrapper(w *writerWrapper) {
 	// 回收资源
 	w.FinishWriting()
 	w.OriginWriter = nil
-	h.wrapperPool.Put(w)
+	w.Request = nil
+	w.state.wrapperPool.Put(w)
 }
 
 type ginBrotliWriter struct {
@@ -192,20 +335,16 @@ func (g *ginBrotliWriter) Flush() {
 
 // Gin implement gin's middleware
 func (h *Handler) Gin(ctx *gin.Context) {
-	var shouldCompress = true
-
-	// 根据请求信息校验是否进行压缩
-	for _, filter := range h.requestFilter {
-		shouldCompress = filter.ShouldCompress(ctx.Request)
-		if !shouldCompress {
-			break
-		}
+	var (
+		state = h.current()
+		req   = ctx.Request
+	)
+	if fullPath := ctx.FullPath(); state.routePattern == nil &&
+		fullPath != "" && fullPath != req.URL.Path {
+		req = WithRoutePattern(req, fullPath)
 	}
 
-	if shouldCompress {
-		wrapper := h.getWriteWrapper()
-		wrapper.Reset(ctx.Writer)
-
+	if wrapper := state.wrap(ctx.Writer, req); wrapper != nil {
 		originWriter := ctx.Writer
 		ctx.Writer = &ginBrotliWriter{
 			originWriter: ctx.Writer,
@@ -220,3 +359,54 @@ func (h *Handler) Gin(ctx *gin.Context) {
 
 	ctx.Next()
 }
+
+// wrap prepares req and returns a wrapper writing to w,
+// nil is returned if req should not be compressed
+func (s *handlerState) wrap(w http.ResponseWriter, req *http.Request) *writerWrapper {
+	var etagMapped bool
+
+	// 还原条件请求中带编码后缀的ETag
+	if s.etagStrategy == ETagSuffix {
+		etagMapped = stripConditionalETags(req.Header)
+	}
+
+	req, ok := s.acceptRequest(req)
+	if !ok {
+		return nil
+	}
+
+	wrapper := s.getWriteWrapper()
+	wrapper.Reset(w, req)
+	wrapper.etagMapped = etagMapped
+	return wrapper
+}
+
+// acceptRequest reports whether responses to req may be compressed,
+// req is returned with the route pattern it matches
+func (s *handlerState) acceptRequest(req *http.Request) (*http.Request, bool) {
+	// 提取路由模板
+	if s.routePattern != nil && RoutePattern(req) == "" {
+		if pattern := s.routePattern(req); pattern != "" {
+			req = WithRoutePattern(req, pattern)
+		}
+	}
+
+	// 根据请求信息校验是否进行压缩
+	filterRequest := req
+	if s.negotiateHead && filterRequest.Method == http.MethodHead {
+		filterRequest = asGetRequest(filterRequest)
+	}
+	for _, filter := range s.requestFilter {
+		if !filter.ShouldCompress(filterRequest) {
+			return req, false
+		}
+	}
+	return req, true
+}
+
+// asGetRequest makes a shallow copy of req as if it were GET
+func asGetRequest(req *http.Request) *http.Request {
+	get := *req
+	get.Method = http.MethodGet
+	return &get
+}
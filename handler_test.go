@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/andybalholm/brotli"
 	"github.com/gin-gonic/gin"
@@ -305,6 +306,511 @@ func TestGinCORSMiddlewareWithDummyConfig(t *testing.T) {
 	assert.EqualValues(t, 0, w.Body.Len())
 }
 
+func TestGinWithResponseFilter(t *testing.T) {
+	var seen ResponseContext
+	g := newGinInstance(bigPayload, NewHandler(Config{
+		CompressionLevel: DefaultCompression,
+		MinContentLength: DefalutContentLen,
+		ResponseFilter: []ResponseFilter{
+			ResponseFilterFunc(func(ctx *ResponseContext) bool {
+				seen = *ctx
+				seen.Buffered = append([]byte(nil), ctx.Buffered...)
+				return !strings.Contains(ctx.Request.UserAgent(), "Mobile") ||
+					!strings.HasPrefix(ctx.Header.Get("Content-Disposition"), "attachment")
+			}),
+		},
+	}).Gin)
+	g.POST("/download", func(ctx *gin.Context) {
+		ctx.Header("Content-Disposition", "attachment; filename=payload.json")
+		ctx.Data(http.StatusOK, "application/json", bigPayload)
+	})
+
+	for _, tc := range []struct {
+		path      string
+		userAgent string
+		encoding  string
+	}{
+		{"/", "Mobile Safari", "br"},
+		{"/download", "Desktop", "br"},
+		{"/download", "Mobile Safari", ""},
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodPost, tc.path, nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		r.Header.Set("User-Agent", tc.userAgent)
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		assert.EqualValues(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, tc.encoding, result.Header.Get("Content-Encoding"), tc.path+" "+tc.userAgent)
+		assert.Equal(t, r, seen.Request)
+		assert.EqualValues(t, http.StatusOK, seen.StatusCode)
+		assert.True(t, bytes.HasPrefix(bigPayload, seen.Buffered))
+		assert.NotEmpty(t, seen.Buffered)
+		assert.EqualValues(t, -1, seen.ContentLength)
+		if tc.encoding == "" {
+			assert.Equal(t, bigPayload, w.Body.Bytes())
+		}
+	}
+}
+
+func TestResponseHeaderFilterAdapter(t *testing.T) {
+	var (
+		adapter = NewResponseHeaderFilterAdapter(DefaultContentTypeFilter())
+		header  = make(http.Header)
+	)
+
+	header.Set("Content-Type", "image/png")
+	assert.False(t, adapter.ShouldCompress(&ResponseContext{Header: header}))
+
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	assert.True(t, adapter.ShouldCompress(&ResponseContext{Header: header}))
+}
+
+func TestGinWithDeclaredContentLength(t *testing.T) {
+	var buffered int
+	g := newGinInstance(bigPayload, NewHandler(Config{
+		CompressionLevel: DefaultCompression,
+		MinContentLength: DefalutContentLen,
+		MaxContentLength: 2 * int64(len(bigPayload)),
+		ResponseFilter: []ResponseFilter{
+			ResponseFilterFunc(func(ctx *ResponseContext) bool {
+				buffered = len(ctx.Buffered)
+				return true
+			}),
+		},
+	}).Gin)
+	g.GET("/declared/:length", func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "application/json")
+		ctx.Header("Content-Length", ctx.Param("length"))
+		for payload := bigPayload; len(payload) > 0; {
+			n := 10
+			if len(payload) < n {
+				n = len(payload)
+			}
+			_, _ = ctx.Writer.Write(payload[:n])
+			payload = payload[n:]
+		}
+	})
+
+	for _, tc := range []struct {
+		length   int
+		encoding string
+	}{
+		{len(bigPayload), "br"},
+		{DefalutContentLen, ""},
+		{3 * len(bigPayload), ""},
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, "/declared/"+strconv.Itoa(tc.length), nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		buffered = 0
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		require.EqualValues(t, http.StatusOK, result.StatusCode)
+		require.Equal(t, tc.encoding, result.Header.Get("Content-Encoding"), tc.length)
+		if tc.encoding == "" {
+			assert.Equal(t, strconv.Itoa(tc.length), result.Header.Get("Content-Length"))
+			assert.Equal(t, bigPayload, w.Body.Bytes())
+			assert.Zero(t, buffered)
+			continue
+		}
+
+		// decided on the first write
+		assert.Equal(t, 10, buffered)
+		assert.Empty(t, result.Header.Get("Content-Length"))
+		body, err := ioutil.ReadAll(brotli.NewReader(result.Body))
+		require.NoError(t, err)
+		assert.Equal(t, bigPayload, body)
+	}
+}
+
+func TestGinWithBufferedCompression(t *testing.T) {
+	g := newGinInstance(bigPayload, NewHandler(Config{
+		CompressionLevel:  DefaultCompression,
+		MinContentLength:  DefalutContentLen,
+		BufferedMaxLength: 2 * DefalutContentLen,
+	}).Gin)
+	g.GET("/chunks/:size", func(ctx *gin.Context) {
+		size, _ := strconv.Atoi(ctx.Param("size"))
+		ctx.Header("Content-Type", "application/json")
+		for payload := bigPayload[:size]; len(payload) > 0; {
+			n := 100
+			if len(payload) < n {
+				n = len(payload)
+			}
+			_, _ = ctx.Writer.Write(payload[:n])
+			payload = payload[n:]
+		}
+	})
+	g.GET("/flush", func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "application/json")
+		_, _ = ctx.Writer.Write(bigPayload[:1500])
+		ctx.Writer.Flush()
+		_, _ = ctx.Writer.Write(bigPayload[1500:])
+	})
+
+	for _, tc := range []struct {
+		path     string
+		size     int
+		buffered bool
+	}{
+		{"/chunks/1500", 1500, true},
+		{"/chunks/" + strconv.Itoa(len(bigPayload)), len(bigPayload), false},
+		{"/", len(bigPayload), false},
+		{"/flush", len(bigPayload), false},
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, tc.path, nil)
+		)
+		if tc.path == "/" {
+			r.Method = http.MethodPost
+		}
+		r.Header.Set("Accept-Encoding", "br")
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		require.EqualValues(t, http.StatusOK, result.StatusCode, tc.path)
+		require.Equal(t, "br", result.Header.Get("Content-Encoding"), tc.path)
+		if tc.buffered {
+			assert.Equal(t, strconv.Itoa(w.Body.Len()), result.Header.Get("Content-Length"), tc.path)
+		} else {
+			assert.Empty(t, result.Header.Get("Content-Length"), tc.path)
+		}
+
+		body, err := ioutil.ReadAll(brotli.NewReader(result.Body))
+		require.NoError(t, err, tc.path)
+		assert.Equal(t, bigPayload[:tc.size], body, tc.path)
+	}
+}
+
+func TestGinWithRange(t *testing.T) {
+	var g = newGinInstance(bigPayload, NewHandler(Config{
+		CompressionLevel: DefaultCompression,
+		MinContentLength: DefalutContentLen,
+	}).Gin)
+	g.GET("/etag", func(ctx *gin.Context) {
+		ctx.Header("ETag", `"abc"`)
+		ctx.Header("Content-Type", "application/json")
+		http.ServeContent(ctx.Writer, ctx.Request, "", time.Time{}, bytes.NewReader(bigPayload))
+	})
+
+	// ranges are served from identity content
+	var (
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/etag", nil)
+	)
+	r.Header.Set("Accept-Encoding", "br")
+	r.Header.Set("Range", "bytes=0-9")
+	g.ServeHTTP(w, r)
+
+	result := w.Result()
+	assert.EqualValues(t, http.StatusPartialContent, result.StatusCode)
+	assert.Empty(t, result.Header.Get("Content-Encoding"))
+	assert.Equal(t, bigPayload[:10], w.Body.Bytes())
+
+	// Accept-Ranges is stripped from compressed content
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/etag", nil)
+	r.Header.Set("Accept-Encoding", "br")
+	g.ServeHTTP(w, r)
+
+	result = w.Result()
+	assert.EqualValues(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "br", result.Header.Get("Content-Encoding"))
+	assert.Empty(t, result.Header.Get("Accept-Ranges"))
+}
+
+func TestGinWithPartialContent(t *testing.T) {
+	var (
+		g = newGinInstance(bigPayload, NewHandler(Config{
+			CompressionLevel: DefaultCompression,
+			MinContentLength: DefalutContentLen,
+		}).Gin)
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/partial", nil)
+	)
+	g.GET("/partial", func(ctx *gin.Context) {
+		ctx.Data(http.StatusPartialContent, "application/json", bigPayload)
+	})
+
+	// filters without Range check still leave 206 alone
+	r.Header.Set("Accept-Encoding", "br")
+	r.Header.Set("Range", "bytes=0-")
+	g.ServeHTTP(w, r)
+
+	result := w.Result()
+	assert.EqualValues(t, http.StatusPartialContent, result.StatusCode)
+	assert.Empty(t, result.Header.Get("Content-Encoding"))
+	assert.Equal(t, bigPayload, w.Body.Bytes())
+}
+
+func TestGinWithNegotiateHead(t *testing.T) {
+	g := newGinInstance(bigPayload, NewHandler(Config{
+		CompressionLevel: DefaultCompression,
+		MinContentLength: DefalutContentLen,
+		ETagStrategy:     ETagSuffix,
+		NegotiateHead:    true,
+		RequestFilter: []RequestFilter{
+			NewCommonRequestFilter(),
+		},
+		ResponseHeaderFilter: []ResponseHeaderFilter{
+			DefaultContentTypeFilter(),
+		},
+	}).Gin)
+	serveContent := func(ctx *gin.Context) {
+		ctx.Header("ETag", `"abc"`)
+		ctx.Header("Content-Type", "application/json")
+		http.ServeContent(ctx.Writer, ctx.Request, "", time.Time{}, bytes.NewReader(bigPayload))
+	}
+	writeBody := func(ctx *gin.Context) {
+		ctx.Header("ETag", `"abc"`)
+		ctx.Data(http.StatusOK, "application/json", bigPayload)
+	}
+	g.GET("/content", serveContent)
+	g.HEAD("/content", serveContent)
+	g.GET("/body", writeBody)
+	g.HEAD("/body", writeBody)
+
+	for _, path := range []string{"/content", "/body"} {
+		var (
+			getW  = httptest.NewRecorder()
+			getR  = httptest.NewRequest(http.MethodGet, path, nil)
+			headW = httptest.NewRecorder()
+			headR = httptest.NewRequest(http.MethodHead, path, nil)
+		)
+		getR.Header.Set("Accept-Encoding", "br")
+		headR.Header.Set("Accept-Encoding", "br")
+		g.ServeHTTP(getW, getR)
+		g.ServeHTTP(headW, headR)
+
+		get, head := getW.Result(), headW.Result()
+		assert.EqualValues(t, http.StatusOK, head.StatusCode, path)
+		assert.Equal(t, "br", get.Header.Get("Content-Encoding"), path)
+		for _, key := range []string{"Content-Encoding", "Vary", "ETag", "Content-Type", "Content-Length"} {
+			assert.Equal(t, get.Header.Values(key), head.Header.Values(key), path+" "+key)
+		}
+		assert.Zero(t, headW.Body.Len(), path)
+	}
+
+	// identity headers for clients not accepting br
+	var (
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodHead, "/content", nil)
+	)
+	r.Header.Set("Accept-Encoding", "gzip")
+	g.ServeHTTP(w, r)
+
+	result := w.Result()
+	assert.Empty(t, result.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(bigPayload)), result.Header.Get("Content-Length"))
+}
+
+func TestAddVary(t *testing.T) {
+	header := make(http.Header)
+	addVary(header, "Accept-Encoding")
+	addVary(header, "Accept-Encoding")
+	assert.Equal(t, []string{"Accept-Encoding"}, header.Values("Vary"))
+
+	header = http.Header{"Vary": {"Origin", "accept-encoding, Accept-Language"}}
+	addVary(header, "Accept-Encoding")
+	assert.Equal(t, []string{"Origin", "accept-encoding, Accept-Language"}, header.Values("Vary"))
+
+	header = http.Header{"Vary": {"Origin"}}
+	addVary(header, "Accept-Encoding")
+	assert.Equal(t, []string{"Origin", "Accept-Encoding"}, header.Values("Vary"))
+
+	header = http.Header{"Vary": {"*"}}
+	addVary(header, "Accept-Encoding")
+	assert.Equal(t, []string{"*"}, header.Values("Vary"))
+}
+
+func TestGinWithVary(t *testing.T) {
+	var g = newGinInstance(bigPayload, func(ctx *gin.Context) {
+		ctx.Header("Vary", "Origin, Accept-Encoding")
+		ctx.Next()
+	}, DefaultHandler().Gin)
+	g.POST("/small", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/json", smallPayload)
+	})
+
+	// merged with Vary set by other middleware
+	for _, tc := range []struct {
+		path     string
+		vary     []string
+		encoding string
+	}{
+		{"/", []string{"Origin, Accept-Encoding"}, "br"},
+		{"/small", []string{"Origin, Accept-Encoding"}, ""},
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodPost, tc.path, nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		assert.Equal(t, tc.encoding, result.Header.Get("Content-Encoding"), tc.path)
+		assert.Equal(t, tc.vary, result.Header.Values("Vary"), tc.path)
+	}
+
+	// eligible but skipped for size
+	g = newGinInstance(bigPayload, DefaultHandler().Gin)
+	g.POST("/small", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/json", smallPayload)
+	})
+	g.POST("/declared", func(ctx *gin.Context) {
+		ctx.Header("Content-Length", strconv.Itoa(len(smallPayload)))
+		ctx.Data(http.StatusOK, "application/json", smallPayload)
+	})
+	g.POST("/image", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "image/png", smallPayload)
+	})
+	for path, vary := range map[string][]string{
+		"/small":    {"Accept-Encoding"},
+		"/declared": {"Accept-Encoding"},
+		"/image":    nil,
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodPost, path, nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		assert.Empty(t, result.Header.Get("Content-Encoding"), path)
+		assert.Equal(t, vary, result.Header.Values("Vary"), path)
+		assert.Equal(t, smallPayload, w.Body.Bytes(), path)
+	}
+}
+
+func TestGinWithRoutePattern(t *testing.T) {
+	var handler = NewHandler(Config{
+		RequestFilter: []RequestFilter{
+			NewCommonRequestFilter(),
+			NewRequestApiFilter([]string{"/users/:id", "/static"}),
+		},
+	})
+	var g = newGinInstance(bigPayload, handler.Gin)
+	for _, path := range []string{"/users/:id", "/static", "/other/:id"} {
+		g.POST(path, func(ctx *gin.Context) {
+			ctx.Data(http.StatusOK, "application/json", bigPayload)
+		})
+	}
+
+	for path, encoding := range map[string]string{
+		"/users/1": "br",
+		"/static":  "br",
+		"/other/1": "",
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodPost, path, nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		g.ServeHTTP(w, r)
+
+		assert.Equal(t, encoding, w.Result().Header.Get("Content-Encoding"), path)
+	}
+}
+
+func TestHTTPWithRoutePattern(t *testing.T) {
+	var handler = NewHandler(Config{
+		RoutePattern: func(req *http.Request) string {
+			if strings.HasPrefix(req.URL.Path, "/users/") {
+				return "/users/{id}"
+			}
+			return ""
+		},
+		RequestFilter: []RequestFilter{
+			NewRequestApiFilter([]string{"/users/{id}"}),
+		},
+		ResponseFilter: []ResponseFilter{
+			ResponseFilterFunc(func(ctx *ResponseContext) bool {
+				return RoutePattern(ctx.Request) == "/users/{id}"
+			}),
+		},
+	})
+	var h = handler.HTTP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bigPayload)
+	}))
+
+	for path, encoding := range map[string]string{
+		"/users/1": "br",
+		"/other/1": "",
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, path, nil)
+		)
+		h.ServeHTTP(w, r)
+
+		assert.Equal(t, encoding, w.Result().Header.Get("Content-Encoding"), path)
+	}
+}
+
+func TestHandlerUpdate(t *testing.T) {
+	var handler = NewHandler(Config{CompressionLevel: 5})
+	var h = handler.HTTP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bigPayload)
+	}))
+	var serve = func() *http.Response {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, "/", nil)
+		)
+		h.ServeHTTP(w, r)
+		return w.Result()
+	}
+	assert.Equal(t, "br", serve().Header.Get("Content-Encoding"))
+
+	// 非法配置不生效
+	assert.Error(t, handler.Update(Config{CompressionLevel: 12}))
+	assert.Equal(t, 5, handler.Config().CompressionLevel)
+
+	// 已开始的响应沿用原配置
+	var (
+		inFlight = httptest.NewRecorder()
+		writer   = handler.Wrap(inFlight, httptest.NewRequest(http.MethodGet, "/", nil))
+		previous = handler.current()
+	)
+	require.NotNil(t, writer)
+	assert.Same(t, previous, writer.wrapper.state)
+
+	require.NoError(t, handler.Update(Config{
+		CompressionLevel: 5,
+		MinContentLength: int64(len(bigPayload)),
+	}))
+	assert.Same(t, previous.brotliWriterPool, handler.current().brotliWriterPool)
+	assert.Equal(t, "", serve().Header.Get("Content-Encoding"))
+
+	writer.Header().Set("Content-Type", "application/json")
+	_, _ = writer.Write(bigPayload)
+	writer.Close()
+	assert.Equal(t, "br", inFlight.Result().Header.Get("Content-Encoding"))
+
+	require.NoError(t, handler.Update(Config{CompressionLevel: BestSpeed}))
+	assert.NotSame(t, previous.brotliWriterPool, handler.current().brotliWriterPool)
+	assert.Equal(t, BestSpeed, handler.Config().CompressionLevel)
+	assert.EqualValues(t, DefalutContentLen, handler.Config().MinContentLength)
+
+	resp := serve()
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	body, err := ioutil.ReadAll(brotli.NewReader(resp.Body))
+	require.NoError(t, err)
+	assert.Equal(t, bigPayload, body)
+}
+
 func BenchmarkGin_SmallPayload(b *testing.B) {
 	var (
 		g = newGinInstance(smallPayload)
@@ -0,0 +1,81 @@
+package brotli
+
+import "net/http"
+
+// Negotiation decides whether the response to a request is compressed,
+// it's meant for adapters of servers without http.ResponseWriter such as
+// brotlifasthttp, which encode the body themselves
+//
+// It keeps the configuration the Handler had when it was started.
+type Negotiation struct {
+	state      *handlerState
+	request    *http.Request
+	etagMapped bool
+}
+
+// Negotiate starts negotiation of req, encoding suffixes are removed from
+// conditional ETags of req.Header when ETagSuffix is used, so it's to be
+// called before req is handled
+func (h *Handler) Negotiate(req *http.Request) *Negotiation {
+	n := Negotiation{
+		state:   h.current(),
+		request: req,
+	}
+
+	// 还原条件请求中带编码后缀的ETag
+	if n.state.etagStrategy == ETagSuffix {
+		n.etagMapped = stripConditionalETags(req.Header)
+	}
+	return &n
+}
+
+// CompressionLevel returns the brotli level to encode with
+func (n *Negotiation) CompressionLevel() int {
+	return n.state.compressionLevel
+}
+
+// MinContentLength returns the length bodies must exceed to be compressed,
+// ResponseFilter wants that much of a streamed body to decide
+func (n *Negotiation) MinContentLength() int64 {
+	return n.state.minContentLength
+}
+
+// Decide reports whether the response may be encoded with brotli, buffered
+// is the body or its beginning and contentLength the length of the whole
+// body, -1 if unknown. header is updated for the representation to be sent.
+func (n *Negotiation) Decide(statusCode int, header http.Header, buffered []byte, contentLength int64) bool {
+	state := n.state
+
+	req, ok := state.acceptRequest(n.request)
+	if !ok {
+		return false
+	}
+
+	if mapsETag(n.etagMapped, statusCode) {
+		// validator the client holds is the brotli one
+		rewriteETag(header, state.etagStrategy)
+		return false
+	}
+	if !statusAllowed(state.statusCodes, statusCode) ||
+		!headerAllowed(state.responseHeaderFilter, header) {
+		return false
+	}
+	if contentLength >= 0 && !lengthAllowed(state.minContentLength, state.maxContentLength, contentLength) {
+		addVary(header, "Accept-Encoding")
+		return false
+	}
+
+	// 响应上下文校验
+	if !responseAllowed(state.responseFilter, &ResponseContext{
+		Request:       req,
+		StatusCode:    statusCode,
+		Header:        header,
+		Buffered:      buffered,
+		ContentLength: contentLength,
+	}) {
+		return false
+	}
+
+	setEncodedHeader(header, state.etagStrategy)
+	return true
+}
@@ -0,0 +1,67 @@
+package brotli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiation(t *testing.T) {
+	handler := NewHandler(Config{
+		CompressionLevel: BestCompression,
+		ETagStrategy:     ETagSuffix,
+		RequestFilter:    []RequestFilter{NewCommonRequestFilter()},
+		ResponseFilter:   []ResponseFilter{NewMagicBytesFilter()},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	req.Header.Set("If-None-Match", `"abc-br"`)
+	negotiation := handler.Negotiate(req)
+	assert.Equal(t, `"abc"`, req.Header.Get("If-None-Match"))
+	assert.Equal(t, BestCompression, negotiation.CompressionLevel())
+	assert.Equal(t, int64(DefalutContentLen), negotiation.MinContentLength())
+
+	header := http.Header{"Etag": {`"abc"`}, "Content-Length": {"2048"}, "Accept-Ranges": {"bytes"}}
+	assert.True(t, negotiation.Decide(http.StatusOK, header, []byte("{}"), 2048))
+	assert.Equal(t, http.Header{
+		"Etag":             {`"abc-br"`},
+		"Content-Encoding": {"br"},
+		"Vary":             {"Accept-Encoding"},
+	}, header)
+
+	// validator of 304 is mapped back though nothing is encoded
+	header = http.Header{"Etag": {`"abc"`}}
+	assert.False(t, negotiation.Decide(http.StatusNotModified, header, nil, 0))
+	assert.Equal(t, `"abc-br"`, header.Get("ETag"))
+
+	header = http.Header{}
+	assert.False(t, negotiation.Decide(http.StatusOK, header, []byte("\x89PNG\r\n\x1a\n"), 2048))
+	assert.Empty(t, header)
+
+	header = http.Header{}
+	assert.False(t, negotiation.Decide(http.StatusOK, header, []byte("{}"), 2))
+	assert.Equal(t, "Accept-Encoding", header.Get("Vary"))
+
+	// same checks as the net/http writer
+	header = http.Header{"Content-Encoding": {" Identity"}}
+	assert.True(t, negotiation.Decide(http.StatusOK, header, []byte("{}"), 2048))
+	assert.Equal(t, "br", header.Get("Content-Encoding"))
+}
+
+func TestNegotiation_MaxContentLength(t *testing.T) {
+	handler := NewHandler(Config{
+		MaxContentLength: 4096,
+		RequestFilter:    []RequestFilter{NewCommonRequestFilter()},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "br")
+
+	// too large is skipped for size as too small is
+	header := http.Header{}
+	assert.False(t, handler.Negotiate(req).Decide(http.StatusOK, header, nil, 8192))
+	assert.Equal(t, "Accept-Encoding", header.Get("Vary"))
+	assert.Empty(t, header.Get("Content-Encoding"))
+}
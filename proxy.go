@@ -0,0 +1,99 @@
+package brotli
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// transcodeKey marks outgoing requests whose gzip responses
+// are to be transcoded, the value is the *handlerState they're served with
+type transcodeKey struct{}
+
+// ReverseProxy returns a handler serving requests with proxy and
+// compressing upstream responses according to h
+//
+// When a response is going to be compressed, upstream is asked for
+// identity content, responses upstream encodes anyway are sent as they are,
+// unless TranscodeGzip is set, in which case gzip responses are decoded
+// and compressed with brotli on the fly. proxy is copied, not modified.
+func (h *Handler) ReverseProxy(proxy *httputil.ReverseProxy) http.Handler {
+	transcoding := *proxy
+	modifyResponse := proxy.ModifyResponse
+	transcoding.ModifyResponse = func(resp *http.Response) error {
+		if modifyResponse != nil {
+			if err := modifyResponse(resp); err != nil {
+				return err
+			}
+		}
+		if state, ok := resp.Request.Context().Value(transcodeKey{}).(*handlerState); ok {
+			state.transcodeResponse(resp, &h.gzipReaders)
+		}
+		return nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writer := h.Wrap(w, req)
+		if writer == nil {
+			transcoding.ServeHTTP(w, req)
+			return
+		}
+		defer writer.Close()
+
+		// 由本地压缩，要求上游返回未编码内容
+		outgoing := cloneRequest(req)
+		outgoing.Header.Set("Accept-Encoding", "identity")
+		if state := writer.wrapper.state; state.transcodeGzip {
+			outgoing = outgoing.WithContext(context.WithValue(outgoing.Context(), transcodeKey{}, state))
+		}
+		transcoding.ServeHTTP(proxyWriter{writer}, outgoing)
+	})
+}
+
+// transcodeResponse decodes gzip body of resp as it's read, leaving
+// compression to the writer. Only bodies whose status or headers rule
+// out compression are left encoded, the decision on length and
+// ResponseFilter comes later, so such bodies are sent decoded. ETag
+// of decoded bodies is weakened either way, it validated gzip bytes
+func (s *handlerState) transcodeResponse(resp *http.Response, pools *readerPools) {
+	if !statusAllowed(s.statusCodes, resp.StatusCode) || resp.Body == nil || resp.Body == http.NoBody ||
+		!strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") ||
+		hasCacheControlDirective(resp.Header, "no-transform") {
+		return
+	}
+
+	// 解码后的响应头须通过响应校验
+	header := resp.Header.Clone()
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	for _, filter := range s.responseHeaderFilter {
+		if !filter.ShouldCompress(header) {
+			return
+		}
+	}
+
+	resp.Body = &decodedBody{
+		pools:    pools,
+		body:     resp.Body,
+		encoding: "gzip",
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	rewriteETag(resp.Header, ETagWeaken)
+}
+
+// proxyWriter ignores flushes before compression is decided, ReverseProxy
+// flushes every chunk of responses without Content-Length, which would
+// send them uncompressed for being too small
+type proxyWriter struct {
+	*ResponseWriter
+}
+
+// Flush implements the http.Flusher interface.
+func (p proxyWriter) Flush() {
+	if wrapper := p.wrapper; wrapper.headerFlushed || wrapper.bodyBigEnough {
+		p.ResponseWriter.Flush()
+	}
+}
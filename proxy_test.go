@@ -0,0 +1,175 @@
+package brotli
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUpstream serves bigPayload, always gzipped under /gzip,
+// /gzip/small serves a gzipped body too short to be compressed
+func newUpstream(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("X-Accept-Encoding", req.Header.Get("Accept-Encoding"))
+		payload := bigPayload
+		switch req.URL.Path {
+		case "/gzip":
+		case "/gzip/small":
+			payload = []byte(`{"code":0,"v":1}` + "\n")
+		default:
+			_, _ = w.Write(payload)
+			return
+		}
+
+		var buffer bytes.Buffer
+		gw := gzip.NewWriter(&buffer)
+		_, _ = gw.Write(payload)
+		_ = gw.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(buffer.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newReverseProxy(t *testing.T, upstream *httptest.Server) *httputil.ReverseProxy {
+	target, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	return httputil.NewSingleHostReverseProxy(target)
+}
+
+func TestHandler_ReverseProxy(t *testing.T) {
+	var (
+		upstream = newUpstream(t)
+		handler  = DefaultHandler().ReverseProxy(newReverseProxy(t, upstream))
+		w        = httptest.NewRecorder()
+		r        = httptest.NewRequest(http.MethodGet, "/", nil)
+	)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	handler.ServeHTTP(w, r)
+
+	result := w.Result()
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	require.Equal(t, "br", result.Header.Get("Content-Encoding"))
+	assert.Equal(t, "identity", result.Header.Get("X-Accept-Encoding"))
+	assert.Equal(t, "Accept-Encoding", result.Header.Get("Vary"))
+	assert.Equal(t, `W/"abc"`, result.Header.Get("ETag"))
+	assert.Empty(t, result.Header.Get("Content-Length"))
+	// the request is left untouched
+	assert.Equal(t, "gzip, br", r.Header.Get("Accept-Encoding"))
+
+	body, err := ioutil.ReadAll(brotli.NewReader(result.Body))
+	require.NoError(t, err)
+	assert.Equal(t, bigPayload, body)
+}
+
+func TestHandler_ReverseProxy_Passthrough(t *testing.T) {
+	var (
+		upstream = newUpstream(t)
+		handler  = DefaultHandler().ReverseProxy(newReverseProxy(t, upstream))
+	)
+
+	// br not accepted, Accept-Encoding is forwarded as is
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(w, r)
+
+	result := w.Result()
+	assert.Empty(t, result.Header.Get("Content-Encoding"))
+	assert.Equal(t, "gzip", result.Header.Get("X-Accept-Encoding"))
+	assert.Equal(t, bigPayload, w.Body.Bytes())
+
+	// upstream encoding is respected
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/gzip", nil)
+	r.Header.Set("Accept-Encoding", "br")
+	handler.ServeHTTP(w, r)
+
+	result = w.Result()
+	require.Equal(t, "gzip", result.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"abc"`, result.Header.Get("ETag"))
+	reader, err := gzip.NewReader(result.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, bigPayload, body)
+}
+
+func TestHandler_ReverseProxy_TranscodeGzip(t *testing.T) {
+	var (
+		upstream = newUpstream(t)
+		proxy    = newReverseProxy(t, upstream)
+		config   = defaultConfig
+	)
+	config.TranscodeGzip = true
+	handler := NewHandler(config).ReverseProxy(proxy)
+	assert.Nil(t, proxy.ModifyResponse)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/gzip", nil)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	handler.ServeHTTP(w, r)
+
+	result := w.Result()
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	require.Equal(t, "br", result.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", result.Header.Get("Vary"))
+	assert.Equal(t, `W/"abc"`, result.Header.Get("ETag"))
+	assert.Empty(t, result.Header.Get("Content-Length"))
+
+	body, err := ioutil.ReadAll(brotli.NewReader(result.Body))
+	require.NoError(t, err)
+	assert.Equal(t, bigPayload, body)
+
+	// gzip is kept for clients not accepting br
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/gzip", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "gzip", w.Result().Header.Get("Content-Encoding"))
+}
+
+func TestHandler_ReverseProxy_TranscodeGzipSmall(t *testing.T) {
+	var (
+		upstream = newUpstream(t)
+		proxy    = newReverseProxy(t, upstream)
+		config   = defaultConfig
+	)
+	config.TranscodeGzip = true
+	config.ETagStrategy = ETagSuffix
+	handler := NewHandler(config).ReverseProxy(proxy)
+
+	// decoded but too small to compress, identity bytes must not share
+	// the strong validator of the gzip bytes
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/gzip/small", nil)
+	r.Header.Set("Accept-Encoding", "br")
+	handler.ServeHTTP(w, r)
+
+	result := w.Result()
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Empty(t, result.Header.Get("Content-Encoding"))
+	assert.Equal(t, `W/"abc"`, result.Header.Get("ETag"))
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"code":0,"v":1}`+"\n", string(body))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/gzip/small", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "gzip", w.Result().Header.Get("Content-Encoding"))
+	assert.Equal(t, `"abc"`, w.Result().Header.Get("ETag"))
+}
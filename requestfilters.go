@@ -1,6 +1,7 @@
 package brotli
 
 import (
+	"context"
 	"net/http"
 	"strings"
 )
@@ -14,6 +15,8 @@ type RequestFilter interface {
 var (
 	_ RequestFilter = &CommonRequestFilter{}
 	_ RequestFilter = &RequestApiFilter{}
+	_ RequestFilter = &RequestApiExcludeFilter{}
+	_ RequestFilter = &NoTransformRequestFilter{}
 )
 
 // CommonRequestFilter judge via common easy criteria like
@@ -26,13 +29,19 @@ func NewCommonRequestFilter() *CommonRequestFilter {
 }
 
 // ShouldCompress implements RequestFilter interface
+//
+// Range requests are skipped, for byte ranges apply
+// to the identity representation.
 func (c *CommonRequestFilter) ShouldCompress(req *http.Request) bool {
 	return req.Method != http.MethodHead &&
 		req.Method != http.MethodOptions &&
 		req.Header.Get("Upgrade") == "" &&
+		req.Header.Get("Range") == "" &&
 		strings.Contains(req.Header.Get("Accept-Encoding"), "br")
 }
 
+// RequestApiFilter compresses listed paths only, a path matches
+// either the request path or its route pattern
 type RequestApiFilter struct {
 	path []string
 }
@@ -45,11 +54,63 @@ func (r *RequestApiFilter) ShouldCompress(req *http.Request) bool {
 	if len(r.path) == 0 {
 		return true
 	}
-	curPath := req.URL.Path
+	curPath, pattern := req.URL.Path, RoutePattern(req)
 	for _, item := range r.path {
-		if item == curPath {
+		if item == curPath || item == pattern && pattern != "" {
 			return true
 		}
 	}
 	return false
 }
+
+// RequestApiExcludeFilter skips listed paths, a path matches
+// either the request path or its route pattern
+type RequestApiExcludeFilter struct {
+	path []string
+}
+
+// NewRequestApiExcludeFilter ...
+func NewRequestApiExcludeFilter(path []string) *RequestApiExcludeFilter {
+	return &RequestApiExcludeFilter{path: path}
+}
+
+// ShouldCompress implements RequestFilter interface
+func (r *RequestApiExcludeFilter) ShouldCompress(req *http.Request) bool {
+	curPath, pattern := req.URL.Path, RoutePattern(req)
+	for _, item := range r.path {
+		if item == curPath || item == pattern && pattern != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// NoTransformRequestFilter skips requests carrying
+// Cache-Control: no-transform
+type NoTransformRequestFilter struct{}
+
+// NewNoTransformRequestFilter ...
+func NewNoTransformRequestFilter() *NoTransformRequestFilter {
+	return &NoTransformRequestFilter{}
+}
+
+// ShouldCompress implements RequestFilter interface
+func (n *NoTransformRequestFilter) ShouldCompress(req *http.Request) bool {
+	return !hasCacheControlDirective(req.Header, "no-transform")
+}
+
+// routePatternKey is the context key of route pattern
+type routePatternKey struct{}
+
+// WithRoutePattern returns a shallow copy of req carrying
+// the route pattern it matched
+func WithRoutePattern(req *http.Request, pattern string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routePatternKey{}, pattern))
+}
+
+// RoutePattern returns the route pattern req matched,
+// empty if it's unknown
+func RoutePattern(req *http.Request) string {
+	pattern, _ := req.Context().Value(routePatternKey{}).(string)
+	return pattern
+}
@@ -1,8 +1,14 @@
 package brotli
 
 import (
+	"bytes"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
 )
 
 // Response filter conditions
@@ -10,12 +16,223 @@ type ResponseHeaderFilter interface {
 	ShouldCompress(header http.Header) bool
 }
 
+// ResponseContext describes a response at the moment
+// compression is about to be decided
+type ResponseContext struct {
+	// Request is the request being served
+	Request *http.Request
+	// StatusCode is the status code set by the handler
+	StatusCode int
+	// Header is the response header, it must not be modified
+	Header http.Header
+	// Buffered is the beginning of the body written so far,
+	// it must not be modified or retained
+	Buffered []byte
+	// ContentLength is the declared Content-Length,
+	// -1 means unknown
+	ContentLength int64
+}
+
+// Response filter conditions with full response context
+type ResponseFilter interface {
+	ShouldCompress(ctx *ResponseContext) bool
+}
+
+// ResponseFilterFunc is an adapter to allow the use of
+// ordinary functions as ResponseFilter
+type ResponseFilterFunc func(ctx *ResponseContext) bool
+
+// ShouldCompress implements ResponseFilter interface
+func (f ResponseFilterFunc) ShouldCompress(ctx *ResponseContext) bool {
+	return f(ctx)
+}
+
 // interface verification
 var (
 	_ ResponseHeaderFilter = (*SkipCompressedFilter)(nil)
 	_ ResponseHeaderFilter = (*ContentTypeFilter)(nil)
+	_ ResponseHeaderFilter = (*NoTransformFilter)(nil)
+	_ ResponseFilter       = ResponseFilterFunc(nil)
+	_ ResponseFilter       = (*ResponseHeaderFilterAdapter)(nil)
+	_ ResponseFilter       = (*MagicBytesFilter)(nil)
+	_ ResponseFilter       = (*TrialCompressionFilter)(nil)
+)
+
+// ResponseHeaderFilterAdapter makes a ResponseHeaderFilter
+// usable as ResponseFilter
+type ResponseHeaderFilterAdapter struct {
+	filter ResponseHeaderFilter
+}
+
+// NewResponseHeaderFilterAdapter ...
+func NewResponseHeaderFilterAdapter(filter ResponseHeaderFilter) *ResponseHeaderFilterAdapter {
+	return &ResponseHeaderFilterAdapter{filter: filter}
+}
+
+// ShouldCompress implements ResponseFilter interface
+func (a *ResponseHeaderFilterAdapter) ShouldCompress(ctx *ResponseContext) bool {
+	return a.filter.ShouldCompress(ctx.Header)
+}
+
+// magicSignature is a known byte sequence at offset
+type magicSignature struct {
+	offset int
+	magic  []byte
+}
+
+// incompressibleSignatures of compressed or media formats
+var incompressibleSignatures = []magicSignature{
+	{0, []byte{0x1f, 0x8b}},                                  // gzip
+	{0, []byte{0x28, 0xb5, 0x2f, 0xfd}},                      // zstd
+	{0, []byte{0xce, 0xb2, 0xcf, 0x81}},                      // brotli framing format
+	{0, []byte("PK\x03\x04")},                                // zip
+	{0, []byte("PK\x05\x06")},                                // empty zip
+	{0, []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}}, // png
+	{0, []byte{0xff, 0xd8, 0xff}},                            // jpeg
+	{8, []byte("WEBP")},                                      // webp, after RIFF header
+	{4, []byte("ftyp")},                                      // mp4 and other ISO media
+	{0, []byte("wOF2")},                                      // woff2
+}
+
+// MagicBytesFilter skips content whose leading bytes match
+// a known compressed or media format, whatever Content-Type says
+type MagicBytesFilter struct {
+	signatures []magicSignature
+}
+
+// NewMagicBytesFilter ...
+func NewMagicBytesFilter() *MagicBytesFilter {
+	return &MagicBytesFilter{signatures: incompressibleSignatures}
+}
+
+// ShouldCompress implements ResponseFilter interface
+func (m *MagicBytesFilter) ShouldCompress(ctx *ResponseContext) bool {
+	for _, item := range m.signatures {
+		if len(ctx.Buffered) < item.offset+len(item.magic) {
+			continue
+		}
+		if bytes.Equal(ctx.Buffered[item.offset:item.offset+len(item.magic)], item.magic) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	// trialMinSample is the shortest prefix worth a trial
+	trialMinSample = 256
+	// trialMaxSample caps the prefix compressed in a trial
+	trialMaxSample = 64 << 10
 )
 
+// trialWriterPool holds fast brotli writers for trial compression
+var trialWriterPool = sync.Pool{
+	New: func() interface{} {
+		return brotli.NewWriterLevel(ioutil.Discard, BestSpeed)
+	},
+}
+
+// CompressionEstimate is the outcome of a trial compression
+type CompressionEstimate struct {
+	// Request is the request being served
+	Request *http.Request
+	// SampleSize is the length of the compressed prefix
+	SampleSize int
+	// CompressedSize is the length of the sample after compression
+	CompressedSize int
+	// Saving is the estimated ratio of bytes saved, 1 - CompressedSize/SampleSize
+	Saving float64
+}
+
+// TrialCompressionFilter compresses the buffered prefix at BestSpeed
+// and skips content whose estimated saving is below minSaving
+type TrialCompressionFilter struct {
+	contentType []string
+	minSaving   float64
+	observer    func(estimate CompressionEstimate)
+}
+
+// NewTrialCompressionFilter creates a TrialCompressionFilter,
+// trials apply to content of types only, or to all content if types is empty.
+// observer, if not nil, receives every estimate.
+func NewTrialCompressionFilter(types []string, minSaving float64, observer func(estimate CompressionEstimate)) *TrialCompressionFilter {
+	return &TrialCompressionFilter{
+		contentType: types,
+		minSaving:   minSaving,
+		observer:    observer,
+	}
+}
+
+// ShouldCompress implements ResponseFilter interface
+func (f *TrialCompressionFilter) ShouldCompress(ctx *ResponseContext) bool {
+	if len(ctx.Buffered) < trialMinSample || !f.matchContentType(ctx.Header) {
+		return true
+	}
+
+	sample := ctx.Buffered
+	if len(sample) > trialMaxSample {
+		sample = sample[:trialMaxSample]
+	}
+
+	var counter byteCounter
+	writer := trialWriterPool.Get().(*brotli.Writer)
+	writer.Reset(&counter)
+	_, _ = writer.Write(sample)
+	_ = writer.Close()
+	writer.Reset(ioutil.Discard)
+	trialWriterPool.Put(writer)
+
+	estimate := CompressionEstimate{
+		Request:        ctx.Request,
+		SampleSize:     len(sample),
+		CompressedSize: int(counter),
+		Saving:         1 - float64(counter)/float64(len(sample)),
+	}
+	if f.observer != nil {
+		f.observer(estimate)
+	}
+	return estimate.Saving >= f.minSaving
+}
+
+// matchContentType
+func (f *TrialCompressionFilter) matchContentType(header http.Header) bool {
+	if len(f.contentType) == 0 {
+		return true
+	}
+
+	contentType := header.Get("Content-Type")
+	for _, item := range f.contentType {
+		if strings.Contains(contentType, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// byteCounter is a writer counting bytes written
+type byteCounter int
+
+// Write implements the io.Writer interface.
+func (c *byteCounter) Write(data []byte) (int, error) {
+	*c += byteCounter(len(data))
+	return len(data), nil
+}
+
+// declaredContentLength parses Content-Length of header,
+// -1 is returned if it's absent or invalid
+func declaredContentLength(header http.Header) int64 {
+	value := header.Get("Content-Length")
+	if value == "" {
+		return -1
+	}
+
+	length, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || length < 0 {
+		return -1
+	}
+	return length
+}
+
 // SkipCompressedFilter judges whether content has been
 // already compressed
 type SkipCompressedFilter struct{}
@@ -32,6 +249,22 @@ func (s *SkipCompressedFilter) ShouldCompress(header http.Header) bool {
 	return header.Get("Content-Encoding") == "" && header.Get("Transfer-Encoding") == ""
 }
 
+// NoTransformFilter skips responses carrying
+// Cache-Control: no-transform
+type NoTransformFilter struct{}
+
+// NewNoTransformFilter ...
+func NewNoTransformFilter() *NoTransformFilter {
+	return &NoTransformFilter{}
+}
+
+// ShouldCompress implements ResponseHeaderFilter interface
+//
+// no-transform: https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.6
+func (n *NoTransformFilter) ShouldCompress(header http.Header) bool {
+	return !hasCacheControlDirective(header, "no-transform")
+}
+
 // ContentTypeFilter
 type ContentTypeFilter struct {
 	contentType []string
@@ -71,3 +304,47 @@ var defaultContentType = []string{
 func DefaultContentTypeFilter() *ContentTypeFilter {
 	return NewContentTypeFilter(defaultContentType)
 }
+
+// hasCacheControlDirective reports whether any Cache-Control line
+// of header contains directive, compared case-insensitively
+func hasCacheControlDirective(header http.Header, directive string) bool {
+	for _, line := range header.Values("Cache-Control") {
+		for _, item := range splitCacheControl(line) {
+			name := item
+			if i := strings.IndexByte(item, '='); i >= 0 {
+				name = item[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(name), directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitCacheControl splits a Cache-Control line by commas
+// outside of quoted strings
+func splitCacheControl(line string) []string {
+	var (
+		items  []string
+		start  int
+		quoted bool
+	)
+
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				items = append(items, line[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, line[start:])
+}
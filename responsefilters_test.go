@@ -0,0 +1,164 @@
+package brotli
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoTransformFilter(t *testing.T) {
+	var filter = NewNoTransformFilter()
+
+	for _, tc := range []struct {
+		lines    []string
+		expected bool
+	}{
+		{nil, true},
+		{[]string{"public, max-age=60"}, true},
+		{[]string{"no-transform"}, false},
+		{[]string{"public, No-Transform"}, false},
+		{[]string{"max-age=60", "NO-TRANSFORM, private"}, false},
+		{[]string{`private="no-transform, x", max-age=60`}, true},
+		{[]string{`private="a\"b,no-transform", no-store`}, true},
+		{[]string{"no-transformx"}, true},
+	} {
+		header := make(http.Header)
+		for _, line := range tc.lines {
+			header.Add("Cache-Control", line)
+		}
+		assert.Equal(t, tc.expected, filter.ShouldCompress(header), tc.lines)
+	}
+}
+
+func TestGinWithDefaultHandler_NoTransform(t *testing.T) {
+	var (
+		g = newGinInstance(bigPayload, DefaultHandler().Gin)
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodPost, "/no-transform", nil)
+	)
+	g.POST("/no-transform", func(ctx *gin.Context) {
+		ctx.Header("Cache-Control", "public, no-transform")
+		ctx.Data(http.StatusOK, "application/json", bigPayload)
+	})
+
+	r.Header.Set("Accept-Encoding", "br")
+	g.ServeHTTP(w, r)
+
+	result := w.Result()
+	assert.EqualValues(t, http.StatusOK, result.StatusCode)
+	assert.Empty(t, result.Header.Get("Content-Encoding"))
+	assert.Equal(t, bigPayload, w.Body.Bytes())
+}
+
+func TestNoTransformRequestFilter(t *testing.T) {
+	var (
+		filter = NewNoTransformRequestFilter()
+		r      = httptest.NewRequest(http.MethodGet, "/", nil)
+	)
+
+	assert.True(t, filter.ShouldCompress(r))
+
+	r.Header.Add("Cache-Control", "max-age=0")
+	r.Header.Add("Cache-Control", "No-Transform")
+	assert.False(t, filter.ShouldCompress(r))
+}
+
+func TestMagicBytesFilter(t *testing.T) {
+	var filter = NewMagicBytesFilter()
+
+	for name, prefix := range map[string][]byte{
+		"gzip":  {0x1f, 0x8b, 0x08, 0x00},
+		"zstd":  {0x28, 0xb5, 0x2f, 0xfd, 0x00},
+		"zip":   []byte("PK\x03\x04\x14\x00"),
+		"png":   {0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00},
+		"jpeg":  {0xff, 0xd8, 0xff, 0xe0},
+		"webp":  []byte("RIFF\x10\x00\x00\x00WEBPVP8 "),
+		"mp4":   []byte("\x00\x00\x00\x18ftypmp42"),
+		"woff2": []byte("wOF2\x00\x01\x00\x00"),
+	} {
+		assert.False(t, filter.ShouldCompress(&ResponseContext{Buffered: prefix}), name)
+	}
+
+	assert.True(t, filter.ShouldCompress(&ResponseContext{}))
+	assert.True(t, filter.ShouldCompress(&ResponseContext{Buffered: []byte{0x1f}}))
+	assert.True(t, filter.ShouldCompress(&ResponseContext{Buffered: bigPayload}))
+}
+
+func TestGinWithMagicBytesFilter(t *testing.T) {
+	config := defaultConfig
+	config.ResponseFilter = []ResponseFilter{NewMagicBytesFilter()}
+	var (
+		g       = newGinInstance(bigPayload, NewHandler(config).Gin)
+		w       = httptest.NewRecorder()
+		r       = httptest.NewRequest(http.MethodPost, "/gzipped", nil)
+		payload = append([]byte{0x1f, 0x8b, 0x08, 0x00}, bigPayload...)
+	)
+	g.POST("/gzipped", func(ctx *gin.Context) {
+		// mislabeled content
+		ctx.Data(http.StatusOK, "text/plain", payload)
+	})
+
+	r.Header.Set("Accept-Encoding", "br")
+	g.ServeHTTP(w, r)
+
+	result := w.Result()
+	assert.EqualValues(t, http.StatusOK, result.StatusCode)
+	assert.Empty(t, result.Header.Get("Content-Encoding"))
+	assert.Equal(t, payload, w.Body.Bytes())
+}
+
+func TestTrialCompressionFilter(t *testing.T) {
+	var (
+		estimates []CompressionEstimate
+		random    = make([]byte, 4096)
+		g         = newGinInstance(bigPayload, NewHandler(Config{
+			CompressionLevel: DefaultCompression,
+			MinContentLength: DefalutContentLen,
+			ResponseFilter: []ResponseFilter{
+				NewTrialCompressionFilter([]string{"text/plain"}, 0.1, func(estimate CompressionEstimate) {
+					estimates = append(estimates, estimate)
+				}),
+			},
+		}).Gin)
+	)
+	_, _ = rand.New(rand.NewSource(1)).Read(random)
+	g.POST("/random", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "text/plain", random)
+	})
+	g.POST("/json", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/json", random)
+	})
+
+	for _, tc := range []struct {
+		path      string
+		encoding  string
+		estimated bool
+	}{
+		{"/", "br", true},
+		{"/random", "", true},
+		{"/json", "br", false},
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodPost, tc.path, nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		estimates = nil
+		g.ServeHTTP(w, r)
+
+		assert.Equal(t, tc.encoding, w.Result().Header.Get("Content-Encoding"), tc.path)
+		if !tc.estimated {
+			assert.Empty(t, estimates, tc.path)
+			continue
+		}
+		require.Len(t, estimates, 1, tc.path)
+		assert.Equal(t, r, estimates[0].Request)
+		assert.NotZero(t, estimates[0].SampleSize)
+		assert.Equal(t, tc.encoding == "br", estimates[0].Saving >= 0.1, tc.path)
+	}
+}
@@ -0,0 +1,112 @@
+package brotli
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter compresses responses for net/http and
+// frameworks built on it, it's created by Handler.Wrap
+//
+// Close must be called once the handler is done.
+type ResponseWriter struct {
+	handler *Handler
+	wrapper *writerWrapper
+	origin  http.ResponseWriter
+}
+
+// interface verification
+var (
+	_ http.ResponseWriter = &ResponseWriter{}
+	_ http.Flusher        = &ResponseWriter{}
+	_ http.Hijacker       = &ResponseWriter{}
+)
+
+// Wrap prepares req and returns a ResponseWriter compressing into w,
+// nil is returned if req should not be compressed.
+func (h *Handler) Wrap(w http.ResponseWriter, req *http.Request) *ResponseWriter {
+	wrapper := h.current().wrap(w, req)
+	if wrapper == nil {
+		return nil
+	}
+
+	return &ResponseWriter{
+		handler: h,
+		wrapper: wrapper,
+		origin:  w,
+	}
+}
+
+// HTTP implements net/http middleware
+func (h *Handler) HTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if writer := h.Wrap(w, req); writer != nil {
+			defer writer.Close()
+			w = writer
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Header implements the http.ResponseWriter interface.
+func (r *ResponseWriter) Header() http.Header {
+	return r.wrapper.Header()
+}
+
+// Write implements the http.ResponseWriter interface.
+func (r *ResponseWriter) Write(data []byte) (int, error) {
+	return r.wrapper.Write(data)
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (r *ResponseWriter) WriteHeader(code int) {
+	r.wrapper.WriteHeader(code)
+}
+
+// Flush implements the http.Flusher interface.
+func (r *ResponseWriter) Flush() {
+	r.wrapper.Flush()
+}
+
+// Hijack implements the http.Hijacker interface.
+func (r *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.origin.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("brotli: underlying ResponseWriter does not implement http.Hijacker")
+	}
+	return hijacker.Hijack()
+}
+
+// Status returns status code set by handler, 0 if none.
+func (r *ResponseWriter) Status() int {
+	return r.wrapper.Status()
+}
+
+// Size returns the length of content written before compression.
+func (r *ResponseWriter) Size() int {
+	return r.wrapper.Size()
+}
+
+// Written reports whether response has been written.
+func (r *ResponseWriter) Written() bool {
+	return r.wrapper.Written()
+}
+
+// Unwrap returns the underlying ResponseWriter,
+// for http.ResponseController.
+func (r *ResponseWriter) Unwrap() http.ResponseWriter {
+	return r.origin
+}
+
+// Close finishes the response,
+// ResponseWriter must not be used afterwards.
+func (r *ResponseWriter) Close() {
+	if r.wrapper == nil {
+		return
+	}
+
+	r.handler.putWriteWrapper(r.wrapper)
+	r.wrapper = nil
+}
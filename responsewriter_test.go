@@ -0,0 +1,75 @@
+package brotli
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_HTTP(t *testing.T) {
+	var handler = DefaultHandler().HTTP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/404" {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		_, _ = w.Write(bigPayload)
+	}))
+
+	for path, status := range map[string]int{
+		"/":    http.StatusOK,
+		"/404": http.StatusNotFound,
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, path, nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		handler.ServeHTTP(w, r)
+
+		result := w.Result()
+		require.EqualValues(t, status, result.StatusCode, path)
+		if status != http.StatusOK {
+			assert.Empty(t, result.Header.Get("Content-Encoding"), path)
+			assert.Equal(t, bigPayload, w.Body.Bytes(), path)
+			continue
+		}
+
+		require.Equal(t, "br", result.Header.Get("Content-Encoding"), path)
+		body, err := ioutil.ReadAll(brotli.NewReader(result.Body))
+		require.NoError(t, err)
+		assert.Equal(t, bigPayload, body)
+	}
+}
+
+func TestHandler_Wrap(t *testing.T) {
+	var (
+		handler = DefaultHandler()
+		w       = httptest.NewRecorder()
+		r       = httptest.NewRequest(http.MethodGet, "/", nil)
+	)
+	assert.Nil(t, handler.Wrap(w, r))
+
+	r.Header.Set("Accept-Encoding", "br")
+	writer := handler.Wrap(w, r)
+	require.NotNil(t, writer)
+
+	writer.Header().Set("Content-Type", "text/plain")
+	_, err := writer.Write(bigPayload)
+	require.NoError(t, err)
+	assert.True(t, writer.Written())
+	assert.EqualValues(t, http.StatusOK, writer.Status())
+	assert.Equal(t, len(bigPayload), writer.Size())
+	writer.Close()
+	writer.Close()
+
+	_, _, err = writer.Hijack()
+	assert.Error(t, err)
+	assert.Equal(t, "br", w.Result().Header.Get("Content-Encoding"))
+}
@@ -0,0 +1,296 @@
+package brotli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Spec is the declarative form of Config, it can be unmarshaled from
+// JSON or YAML and overridden by environment variables
+type Spec struct {
+	// 压缩等级，为空则使用DefaultCompression
+	Level *int `json:"level,omitempty" yaml:"level,omitempty" env:"LEVEL"`
+	// 响应内容长度，为0则使用DefalutContentLen
+	MinLength int64 `json:"min_length,omitempty" yaml:"min_length,omitempty" env:"MIN_LENGTH"`
+	// 声明的响应内容长度超过此值时不压缩，0表示不限制
+	MaxLength int64 `json:"max_length,omitempty" yaml:"max_length,omitempty" env:"MAX_LENGTH"`
+	// 内存压缩并输出Content-Length的长度上限，0表示始终流式输出
+	BufferedMaxLength int64 `json:"buffered_max_length,omitempty" yaml:"buffered_max_length,omitempty" env:"BUFFERED_MAX_LENGTH"`
+	// 压缩的响应状态码，为空则仅压缩200
+	StatusCodes []int `json:"status_codes,omitempty" yaml:"status_codes,omitempty" env:"STATUS_CODES"`
+	// 压缩的路径或路由，为空则不限制
+	IncludePaths []string `json:"include_paths,omitempty" yaml:"include_paths,omitempty" env:"INCLUDE_PATHS"`
+	// 不压缩的路径或路由
+	ExcludePaths []string `json:"exclude_paths,omitempty" yaml:"exclude_paths,omitempty" env:"EXCLUDE_PATHS"`
+	// 压缩的Content-Type，为空则使用默认列表
+	ContentTypes []string `json:"content_types,omitempty" yaml:"content_types,omitempty" env:"CONTENT_TYPES"`
+	// 输出的编码，目前仅支持br，为空则为br
+	Encodings []string `json:"encodings,omitempty" yaml:"encodings,omitempty" env:"ENCODINGS"`
+	// 压缩后ETag的处理方式：weaken、suffix或keep，为空则为weaken
+	ETag string `json:"etag,omitempty" yaml:"etag,omitempty" env:"ETAG"`
+	// HEAD请求按对应GET请求协商
+	NegotiateHead bool `json:"negotiate_head,omitempty" yaml:"negotiate_head,omitempty" env:"NEGOTIATE_HEAD"`
+	// 压缩后内容摘要：sha-256或sha-512，为空则不计算
+	ContentDigest string `json:"content_digest,omitempty" yaml:"content_digest,omitempty" env:"CONTENT_DIGEST"`
+	// 输出压缩前长度、压缩率等指标
+	CompressionTrailers bool `json:"compression_trailers,omitempty" yaml:"compression_trailers,omitempty" env:"COMPRESSION_TRAILERS"`
+	// 通过Server-Timing输出压缩耗时及压缩率
+	ServerTiming bool `json:"server_timing,omitempty" yaml:"server_timing,omitempty" env:"SERVER_TIMING"`
+	// ReverseProxy收到gzip编码的上游响应时以brotli重新压缩
+	TranscodeGzip bool `json:"transcode_gzip,omitempty" yaml:"transcode_gzip,omitempty" env:"TRANSCODE_GZIP"`
+	// 按内容头部的特征字节跳过已压缩的数据，如PNG、ZIP、gzip
+	SniffMagicBytes bool `json:"sniff_magic_bytes,omitempty" yaml:"sniff_magic_bytes,omitempty" env:"SNIFF_MAGIC_BYTES"`
+}
+
+// etagStrategies maps Spec.ETag to ETagStrategy
+var etagStrategies = map[string]ETagStrategy{
+	"":       ETagWeaken,
+	"weaken": ETagWeaken,
+	"suffix": ETagSuffix,
+	"keep":   ETagKeep,
+}
+
+// LoadSpec reads spec from a JSON or YAML file, the format is chosen
+// by extension, unknown fields are rejected
+func LoadSpec(path string) (Spec, error) {
+	var spec Spec
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return spec, err
+	}
+	return spec, UnmarshalSpec(data, filepath.Ext(path), &spec)
+}
+
+// UnmarshalSpec decodes data of format (.json, .yaml or .yml) into v,
+// unknown fields are rejected, v may embed Spec
+func UnmarshalSpec(data []byte, format string, v interface{}) error {
+	switch strings.ToLower(format) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(v)
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(data, v)
+	default:
+		return fmt.Errorf("brotli: unsupported config format %q", format)
+	}
+}
+
+// ApplyEnv overrides fields of s with environment variables named
+// prefix followed by the env tag of the field, lists are comma separated
+func (s *Spec) ApplyEnv(prefix string) error {
+	return ApplyEnv(prefix, s)
+}
+
+// ApplyEnv overrides tagged fields of the struct v points to as
+// Spec.ApplyEnv does, fields of embedded structs included, so settings
+// kept next to an embedded Spec can be overridden as well
+func ApplyEnv(prefix string, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("brotli: ApplyEnv needs a pointer to struct, got %T", v)
+	}
+
+	var errs ValidationError
+	applyEnv(prefix, value.Elem(), &errs)
+	return errs.err()
+}
+
+// applyEnv overrides fields of value, descending into embedded structs
+func applyEnv(prefix string, value reflect.Value, errs *ValidationError) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			applyEnv(prefix, value.Field(i), errs)
+			continue
+		}
+		tag := field.Tag.Get("env")
+		if tag == "" || field.PkgPath != "" {
+			continue
+		}
+
+		name := prefix + tag
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvField(value.Field(i), strings.TrimSpace(env)); err != nil {
+			errs.add(name, "%v", err)
+		}
+	}
+}
+
+// setEnvField parses env into field
+func setEnvField(field reflect.Value, env string) error {
+	switch field.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(field.Type().Elem())
+		if err := setEnvField(elem.Elem(), env); err != nil {
+			return err
+		}
+		field.Set(elem)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.String:
+		field.SetString(env)
+	case reflect.Slice:
+		items := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			elem := reflect.New(field.Type().Elem()).Elem()
+			if err := setEnvField(elem, item); err != nil {
+				return err
+			}
+			items = reflect.Append(items, elem)
+		}
+		field.Set(items)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// specFields maps Config fields to the Spec fields they're built from
+var specFields = map[string]string{
+	"CompressionLevel":  "level",
+	"MinContentLength":  "min_length",
+	"MaxContentLength":  "max_length",
+	"BufferedMaxLength": "buffered_max_length",
+	"StatusCodes":       "status_codes",
+	"ContentDigest":     "content_digest",
+}
+
+// Config builds Config from s, every invalid field is reported
+// in a ValidationError by its Spec name
+func (s *Spec) Config() (Config, error) {
+	var errs ValidationError
+
+	// 仅校验Spec特有字段，其余由Config.Validate校验
+	excluded := make(map[string]bool, len(s.ExcludePaths))
+	for _, path := range s.ExcludePaths {
+		excluded[path] = true
+	}
+	for _, path := range s.IncludePaths {
+		if excluded[path] {
+			errs.add("include_paths", "%q is excluded as well", path)
+		}
+	}
+	for _, contentType := range s.ContentTypes {
+		if strings.TrimSpace(contentType) == "" {
+			errs.add("content_types", "must not contain empty type")
+		}
+	}
+	for _, encoding := range s.Encodings {
+		if !strings.EqualFold(encoding, "br") {
+			errs.add("encodings", "unsupported encoding %q", encoding)
+		}
+	}
+	etagStrategy, ok := etagStrategies[strings.ToLower(s.ETag)]
+	if !ok {
+		errs.add("etag", "must be one of weaken, suffix and keep")
+	}
+
+	level := DefaultCompression
+	if s.Level != nil {
+		level = *s.Level
+	}
+	minLength := s.MinLength
+	if minLength == 0 {
+		minLength = DefalutContentLen
+	}
+
+	requestFilter := []RequestFilter{
+		NewCommonRequestFilter(),
+		NewNoTransformRequestFilter(),
+	}
+	if len(s.IncludePaths) > 0 {
+		requestFilter = append(requestFilter, NewRequestApiFilter(s.IncludePaths))
+	}
+	if len(s.ExcludePaths) > 0 {
+		requestFilter = append(requestFilter, NewRequestApiExcludeFilter(s.ExcludePaths))
+	}
+	contentTypeFilter := DefaultContentTypeFilter()
+	if len(s.ContentTypes) > 0 {
+		contentTypeFilter = NewContentTypeFilter(s.ContentTypes)
+	}
+
+	config := Config{
+		CompressionLevel:    level,
+		MinContentLength:    minLength,
+		MaxContentLength:    s.MaxLength,
+		BufferedMaxLength:   s.BufferedMaxLength,
+		ETagStrategy:        etagStrategy,
+		NegotiateHead:       s.NegotiateHead,
+		ContentDigest:       strings.ToLower(s.ContentDigest),
+		CompressionTrailers: s.CompressionTrailers,
+		ServerTiming:        s.ServerTiming,
+		StatusCodes:         s.StatusCodes,
+		TranscodeGzip:       s.TranscodeGzip,
+		RequestFilter:       requestFilter,
+		ResponseHeaderFilter: []ResponseHeaderFilter{
+			NewNoTransformFilter(),
+			contentTypeFilter,
+		},
+	}
+	if s.SniffMagicBytes {
+		config.ResponseFilter = []ResponseFilter{NewMagicBytesFilter()}
+	}
+
+	if err, ok := config.Validate().(ValidationError); ok {
+		for _, field := range err {
+			errs.add(specField(field.Field), "%s", specMessage(field.Message))
+		}
+	}
+	if err := errs.err(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// specField returns the Spec name of a Config field
+func specField(field string) string {
+	if name, ok := specFields[field]; ok {
+		return name
+	}
+	return field
+}
+
+// specMessage replaces Config field names in message with Spec names
+func specMessage(message string) string {
+	for field, name := range specFields {
+		message = strings.Replace(message, field, name, -1)
+	}
+	return message
+}
+
+// NewHandlerFromSpec creates a handler from spec, unlike NewHandler,
+// invalid fields are reported instead of replaced with defaults
+func NewHandlerFromSpec(spec Spec) (*Handler, error) {
+	config, err := spec.Config()
+	if err != nil {
+		return nil, err
+	}
+	// Spec.Config已校验
+	return NewHandler(config), nil
+}
@@ -0,0 +1,200 @@
+package brotli
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSpec(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "brotli-spec")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadSpec(t *testing.T) {
+	jsonSpec, err := LoadSpec(writeSpec(t, "spec.json", `{
+		"level": 5,
+		"min_length": 512,
+		"status_codes": [200, 201],
+		"exclude_paths": ["/raw"],
+		"etag": "suffix"
+	}`))
+	require.NoError(t, err)
+
+	yamlSpec, err := LoadSpec(writeSpec(t, "spec.yml", `
+level: 5
+min_length: 512
+status_codes: [200, 201]
+exclude_paths:
+  - /raw
+etag: suffix
+`))
+	require.NoError(t, err)
+	assert.Equal(t, jsonSpec, yamlSpec)
+	require.NotNil(t, yamlSpec.Level)
+	assert.Equal(t, 5, *yamlSpec.Level)
+
+	for name, content := range map[string]string{
+		"typo.json": `{"levle": 5}`,
+		"typo.yaml": `levle: 5`,
+		"spec.toml": `level = 5`,
+	} {
+		_, err = LoadSpec(writeSpec(t, name, content))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSpecApplyEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"TEST_BROTLI_LEVEL":         "3",
+		"TEST_BROTLI_MIN_LENGTH":    "2048",
+		"TEST_BROTLI_STATUS_CODES":  "200, 201",
+		"TEST_BROTLI_INCLUDE_PATHS": "/api,/users/:id,",
+		"TEST_BROTLI_SERVER_TIMING": "true",
+	} {
+		require.NoError(t, os.Setenv(name, value))
+		defer os.Unsetenv(name)
+	}
+
+	spec := Spec{MinLength: 512, ETag: "keep"}
+	require.NoError(t, spec.ApplyEnv("TEST_BROTLI_"))
+	require.NotNil(t, spec.Level)
+	assert.Equal(t, 3, *spec.Level)
+	assert.EqualValues(t, 2048, spec.MinLength)
+	assert.Equal(t, []int{200, 201}, spec.StatusCodes)
+	assert.Equal(t, []string{"/api", "/users/:id"}, spec.IncludePaths)
+	assert.True(t, spec.ServerTiming)
+	assert.Equal(t, "keep", spec.ETag)
+
+	require.NoError(t, os.Setenv("TEST_BROTLI_LEVEL", "fast"))
+	require.NoError(t, os.Setenv("TEST_BROTLI_NEGOTIATE_HEAD", "maybe"))
+	defer os.Unsetenv("TEST_BROTLI_NEGOTIATE_HEAD")
+	err := spec.ApplyEnv("TEST_BROTLI_")
+	require.IsType(t, ValidationError{}, err)
+	assert.Len(t, err.(ValidationError), 2)
+}
+
+func TestApplyEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"TEST_BROTLI_LEVEL":    "3",
+		"TEST_BROTLI_UPSTREAM": "http://127.0.0.1:3000",
+		"TEST_BROTLI_ENTRIES":  "100",
+	} {
+		require.NoError(t, os.Setenv(name, value))
+		defer os.Unsetenv(name)
+	}
+
+	// settings kept next to an embedded Spec
+	var config struct {
+		Spec
+		Upstream string `env:"UPSTREAM"`
+		Entries  int    `env:"ENTRIES"`
+		Untagged string
+	}
+	require.NoError(t, ApplyEnv("TEST_BROTLI_", &config))
+	require.NotNil(t, config.Level)
+	assert.Equal(t, 3, *config.Level)
+	assert.Equal(t, "http://127.0.0.1:3000", config.Upstream)
+	assert.Equal(t, 100, config.Entries)
+	assert.Empty(t, config.Untagged)
+
+	assert.Error(t, ApplyEnv("TEST_BROTLI_", config))
+}
+
+func TestSpecConfig(t *testing.T) {
+	config, err := (&Spec{}).Config()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultCompression, config.CompressionLevel)
+	assert.EqualValues(t, DefalutContentLen, config.MinContentLength)
+	assert.Equal(t, ETagWeaken, config.ETagStrategy)
+	assert.Empty(t, config.ResponseFilter)
+
+	config, err = (&Spec{SniffMagicBytes: true}).Config()
+	require.NoError(t, err)
+	require.Len(t, config.ResponseFilter, 1)
+	assert.IsType(t, &MagicBytesFilter{}, config.ResponseFilter[0])
+
+	level := 12
+	_, err = (&Spec{
+		Level:         &level,
+		MinLength:     -1,
+		StatusCodes:   []int{200, 206, 304},
+		IncludePaths:  []string{"/api"},
+		ExcludePaths:  []string{"/api"},
+		Encodings:     []string{"br", "gzip"},
+		ETag:          "strong",
+		ContentDigest: "md5",
+	}).Config()
+	require.IsType(t, ValidationError{}, err)
+
+	var fields []string
+	for _, field := range err.(ValidationError) {
+		fields = append(fields, field.Field)
+	}
+	// Spec fields first, then those Config.Validate reports
+	assert.Equal(t, []string{
+		"include_paths", "encodings", "etag", "level", "min_length",
+		"content_digest", "status_codes", "status_codes",
+	}, fields)
+	assert.Contains(t, err.Error(), "level: 12 is not between 0 and 11; min_length: must not be negative")
+
+	_, err = (&Spec{StatusCodes: []int{404, 500}}).Config()
+	assert.NoError(t, err)
+
+	_, err = (&Spec{MaxLength: 512}).Config()
+	require.IsType(t, ValidationError{}, err)
+	assert.Equal(t, "brotli: invalid configuration: max_length: must not be less than min_length 1024", err.Error())
+
+	handler, err := NewHandlerFromSpec(Spec{Level: &level})
+	assert.Nil(t, handler)
+	assert.Error(t, err)
+}
+
+func TestHTTPWithSpec(t *testing.T) {
+	handler, err := NewHandlerFromSpec(Spec{
+		StatusCodes:  []int{http.StatusOK, http.StatusCreated},
+		ExcludePaths: []string{"/raw"},
+		ContentTypes: []string{"application/json"},
+	})
+	require.NoError(t, err)
+
+	var h = handler.HTTP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/created" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		if req.URL.Path == "/accepted" {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		_, _ = w.Write(bigPayload)
+	}))
+
+	for path, encoding := range map[string]string{
+		"/api":      "br",
+		"/created":  "br",
+		"/accepted": "",
+		"/raw":      "",
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, path, nil)
+		)
+		r.Header.Set("Accept-Encoding", "br")
+		h.ServeHTTP(w, r)
+
+		assert.Equal(t, encoding, w.Result().Header.Get("Content-Encoding"), path)
+	}
+}
@@ -0,0 +1,75 @@
+package brotli
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Compression trailers, sent if Config.CompressionTrailers is set
+const (
+	// UncompressedLengthTrailer carries the length of content before compression
+	UncompressedLengthTrailer = "X-Brotli-Uncompressed-Length"
+	// CompressionRatioTrailer carries the ratio of bytes saved
+	CompressionRatioTrailer = "X-Brotli-Ratio"
+)
+
+// compressionStats of a finished response
+type compressionStats struct {
+	uncompressed int64
+	compressed   int64
+	duration     time.Duration
+}
+
+// ratio of bytes saved, like 0.72 for 1000 bytes compressed to 280
+func (s compressionStats) ratio() float64 {
+	if s.uncompressed <= 0 {
+		return 0
+	}
+	return 1 - float64(s.compressed)/float64(s.uncompressed)
+}
+
+// serverTiming formats stats as a Server-Timing metric
+//
+// https://www.w3.org/TR/server-timing/
+func (s compressionStats) serverTiming() string {
+	return "br;dur=" + strconv.FormatFloat(float64(s.duration)/float64(time.Millisecond), 'f', 1, 64) +
+		`;desc="ratio ` + strconv.FormatFloat(s.ratio(), 'f', 2, 64) + `"`
+}
+
+// declaresTrailers reports whether trailers are announced,
+// by Trailer header or by keys with http.TrailerPrefix
+func declaresTrailers(header http.Header) bool {
+	if len(header["Trailer"]) > 0 {
+		return true
+	}
+	for key := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeServerTiming appends metric to Server-Timing entries of header
+func mergeServerTiming(header http.Header, metric string) {
+	values := header.Values("Server-Timing")
+	if len(values) == 0 {
+		header.Set("Server-Timing", metric)
+		return
+	}
+	header.Set("Server-Timing", strings.Join(values, ", ")+", "+metric)
+}
+
+// hasToken reports whether token is listed in comma separated lines
+func hasToken(lines []string, token string) bool {
+	for _, line := range lines {
+		for _, item := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package brotli
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGinWithTrailers(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		bufferedMaxLength   int64
+		compressionTrailers bool
+	}{
+		{"handler", 0, false},
+		// trailers of handler can't go with Content-Length
+		{"handler buffered", int64(len(bigPayload)), false},
+		{"compression", 0, true},
+	} {
+		var (
+			g = newGinInstance(bigPayload, NewHandler(Config{
+				CompressionLevel:    DefaultCompression,
+				MinContentLength:    DefalutContentLen,
+				BufferedMaxLength:   tc.bufferedMaxLength,
+				CompressionTrailers: tc.compressionTrailers,
+			}).Gin)
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, "/trailer", nil)
+		)
+		g.GET("/trailer", func(ctx *gin.Context) {
+			ctx.Header("Trailer", "X-Checksum")
+			ctx.Data(http.StatusOK, "application/json", bigPayload)
+			ctx.Header("X-Checksum", "42")
+		})
+		r.Header.Set("Accept-Encoding", "br")
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		require.Equal(t, "br", result.Header.Get("Content-Encoding"), tc.name)
+		// trailers need chunked encoding
+		assert.Empty(t, result.Header.Get("Content-Length"), tc.name)
+		assert.Equal(t, "42", result.Trailer.Get("X-Checksum"), tc.name)
+		if !tc.compressionTrailers {
+			body, err := ioutil.ReadAll(brotli.NewReader(result.Body))
+			require.NoError(t, err, tc.name)
+			assert.Equal(t, bigPayload, body, tc.name)
+			continue
+		}
+
+		assert.Equal(t, []string{"X-Checksum", UncompressedLengthTrailer, CompressionRatioTrailer, "Server-Timing"},
+			result.Header.Values("Trailer"))
+		assert.Equal(t, strconv.Itoa(len(bigPayload)), result.Trailer.Get(UncompressedLengthTrailer))
+		ratio, err := strconv.ParseFloat(result.Trailer.Get(CompressionRatioTrailer), 64)
+		require.NoError(t, err)
+		assert.InDelta(t, 1-float64(w.Body.Len())/float64(len(bigPayload)), ratio, 0.01)
+		assert.True(t, strings.HasPrefix(result.Trailer.Get("Server-Timing"), "br;dur="))
+	}
+}
+
+func TestGinWithCompressionTrailers_Buffered(t *testing.T) {
+	var (
+		g = newGinInstance(bigPayload, NewHandler(Config{
+			CompressionLevel:    DefaultCompression,
+			MinContentLength:    DefalutContentLen,
+			BufferedMaxLength:   int64(len(bigPayload)),
+			CompressionTrailers: true,
+		}).Gin)
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodPost, "/", nil)
+	)
+	r.Header.Set("Accept-Encoding", "br")
+	g.ServeHTTP(w, r)
+
+	// known before header is sent
+	result := w.Result()
+	require.Equal(t, "br", result.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(w.Body.Len()), result.Header.Get("Content-Length"))
+	assert.Empty(t, result.Header.Get("Trailer"))
+	assert.Equal(t, strconv.Itoa(len(bigPayload)), result.Header.Get(UncompressedLengthTrailer))
+	assert.NotEmpty(t, result.Header.Get(CompressionRatioTrailer))
+	assert.NotEmpty(t, result.Header.Get("Server-Timing"))
+}
+
+func TestCompressionStats_ServerTiming(t *testing.T) {
+	stats := compressionStats{
+		uncompressed: 1000,
+		compressed:   280,
+		duration:     3200 * time.Microsecond,
+	}
+	assert.Equal(t, `br;dur=3.2;desc="ratio 0.72"`, stats.serverTiming())
+	assert.Zero(t, compressionStats{}.ratio())
+}
+
+func TestGinWithServerTiming(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		bufferedMaxLength int64
+		declared          bool
+	}{
+		{"header", int64(len(bigPayload)), false},
+		{"trailer", 0, false},
+		{"declared trailer", 0, true},
+	} {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, "/timing", nil)
+			g = newGinInstance(bigPayload, NewHandler(Config{
+				CompressionLevel:  DefaultCompression,
+				MinContentLength:  DefalutContentLen,
+				BufferedMaxLength: tc.bufferedMaxLength,
+				ServerTiming:      true,
+			}).Gin)
+			declared = tc.declared
+		)
+		g.GET("/timing", func(ctx *gin.Context) {
+			if declared {
+				ctx.Header("Trailer", "Server-Timing")
+			} else {
+				ctx.Header("Server-Timing", "db;dur=53")
+			}
+			ctx.Data(http.StatusOK, "application/json", bigPayload)
+			if declared {
+				ctx.Header("Server-Timing", "db;dur=53")
+			}
+		})
+		r.Header.Set("Accept-Encoding", "br")
+		g.ServeHTTP(w, r)
+
+		result := w.Result()
+		require.Equal(t, "br", result.Header.Get("Content-Encoding"), tc.name)
+		assert.Empty(t, result.Header.Get(UncompressedLengthTrailer), tc.name)
+
+		switch tc.name {
+		case "header":
+			assert.Regexp(t, `^db;dur=53, br;dur=[0-9.]+;desc="ratio 0\.[0-9]{2}"$`, result.Header.Get("Server-Timing"))
+			assert.Empty(t, result.Header.Get("Trailer"))
+		case "trailer":
+			assert.Equal(t, "db;dur=53", result.Header.Get("Server-Timing"))
+			assert.Equal(t, []string{"Server-Timing"}, result.Header.Values("Trailer"))
+			assert.Regexp(t, `^br;dur=[0-9.]+;desc="ratio 0\.[0-9]{2}"$`, result.Trailer.Get("Server-Timing"))
+		default:
+			assert.Equal(t, []string{"Server-Timing"}, result.Header.Values("Trailer"))
+			assert.Regexp(t, `^db;dur=53, br;dur=[0-9.]+;desc="ratio 0\.[0-9]{2}"$`, result.Trailer.Get("Server-Timing"))
+		}
+	}
+}
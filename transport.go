@@ -0,0 +1,223 @@
+package brotli
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// ErrDecodedBodyTooLarge is returned reading a response body
+// decoded beyond TransportConfig.MaxDecodedLength
+var ErrDecodedBodyTooLarge = errors.New("brotli: decoded response body too large")
+
+const (
+	// acceptEncoding is advertised by Transport
+	acceptEncoding = "br, gzip"
+	// originalEncodingHeader keeps Content-Encoding of decoded responses,
+	// resp.Body may be wrapped by http.Client so it's kept in resp.Header
+	originalEncodingHeader = "X-Original-Content-Encoding"
+)
+
+// TransportConfig is used in Transport initialization
+type TransportConfig struct {
+	// 实际发送请求的RoundTripper，为空则使用http.DefaultTransport
+	Base http.RoundTripper
+	// 解压后响应长度上限，0表示不限制
+	MaxDecodedLength int64
+	// 请求体长度超过此值时以brotli压缩，0表示不压缩
+	MinRequestLength int64
+	// 请求体压缩等级
+	RequestCompressionLevel int
+}
+
+// Transport is a http.RoundTripper decoding br and gzip responses
+//
+// Accept-Encoding is advertised unless the request sets it or asks for
+// a Range, in which case the response is returned untouched as
+// http.Transport does. Decoded responses have Content-Encoding and
+// Content-Length removed, the original encoding is reported by
+// OriginalEncoding and kept in X-Original-Content-Encoding.
+//
+// Request bodies longer than MinRequestLength are compressed if their
+// length is known and GetBody is set, which is the case for requests
+// created by http.NewRequest with in-memory bodies. Hosts answering
+// 415 Unsupported Media Type are sent identity bodies from then on.
+type Transport struct {
+	base                    http.RoundTripper
+	maxDecodedLength        int64
+	minRequestLength        int64
+	requestCompressionLevel int
+	readers                 readerPools
+	brotliWriterPool        sync.Pool
+	// 不支持压缩请求体的host
+	identityHosts sync.Map
+}
+
+// interface verification
+var _ http.RoundTripper = &Transport{}
+
+// NewTransport ...
+func NewTransport(config TransportConfig) *Transport {
+	if config.Base == nil {
+		config.Base = http.DefaultTransport
+	}
+	// 设置压缩等级不符合则，使用默认等级
+	if config.RequestCompressionLevel < BestSpeed || config.RequestCompressionLevel > BestCompression {
+		config.RequestCompressionLevel = DefaultCompression
+	}
+
+	t := Transport{
+		base:                    config.Base,
+		maxDecodedLength:        config.MaxDecodedLength,
+		minRequestLength:        config.MinRequestLength,
+		requestCompressionLevel: config.RequestCompressionLevel,
+	}
+	t.brotliWriterPool.New = func() interface{} {
+		return brotli.NewWriterLevel(ioutil.Discard, t.requestCompressionLevel)
+	}
+	return &t
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	outgoing := req
+	advertise := req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == ""
+	if advertise {
+		outgoing = cloneRequest(req)
+		outgoing.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if t.shouldCompressRequest(req) {
+		resp, err = t.roundTripCompressed(outgoing)
+	} else {
+		resp, err = t.base.RoundTrip(outgoing)
+	}
+	if err != nil || !advertise {
+		return resp, err
+	}
+	return t.decodeResponse(req, resp), nil
+}
+
+// shouldCompressRequest reports whether body of req is to be compressed
+func (t *Transport) shouldCompressRequest(req *http.Request) bool {
+	if t.minRequestLength <= 0 || req.Body == nil || req.Body == http.NoBody ||
+		req.GetBody == nil || req.ContentLength <= t.minRequestLength ||
+		req.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	_, identity := t.identityHosts.Load(req.URL.Host)
+	return !identity
+}
+
+// roundTripCompressed sends req with compressed body, falling back
+// to identity body if the server answers 415 Unsupported Media Type
+func (t *Transport) roundTripCompressed(req *http.Request) (*http.Response, error) {
+	compressed, err := t.compressRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(compressed)
+	if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		return resp, err
+	}
+
+	// 服务端不支持压缩请求体，记录后以原始内容重试
+	t.identityHosts.Store(req.URL.Host, struct{}{})
+	body, err := req.GetBody()
+	if err != nil {
+		return resp, nil
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	identity := cloneRequest(req)
+	identity.Body = body
+	return t.base.RoundTrip(identity)
+}
+
+// compressRequest returns a copy of req whose body is compressed,
+// body of req is consumed and closed
+func (t *Transport) compressRequest(req *http.Request) (*http.Request, error) {
+	defer req.Body.Close()
+
+	var buffer bytes.Buffer
+	writer := t.brotliWriterPool.Get().(*brotli.Writer)
+	writer.Reset(&buffer)
+	_, err := io.Copy(writer, req.Body)
+	if err == nil {
+		err = writer.Close()
+	}
+	writer.Reset(ioutil.Discard)
+	t.brotliWriterPool.Put(writer)
+	if err != nil {
+		return nil, err
+	}
+
+	body := buffer.Bytes()
+	compressed := cloneRequest(req)
+	compressed.Header.Set("Content-Encoding", "br")
+	compressed.Header.Del("Content-Length")
+	compressed.ContentLength = int64(len(body))
+	compressed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	// 供重试及重定向使用
+	compressed.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return compressed, nil
+}
+
+// decodeResponse replaces body of resp with a decoding one
+// if it's encoded with br or gzip
+func (t *Transport) decodeResponse(req *http.Request, resp *http.Response) *http.Response {
+	if resp.Body == nil || resp.Body == http.NoBody || req.Method == http.MethodHead {
+		return resp
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "br" && encoding != "gzip" {
+		return resp
+	}
+
+	resp.Body = &decodedBody{
+		pools:     &t.readers,
+		body:      resp.Body,
+		encoding:  encoding,
+		remaining: t.maxDecodedLength,
+		limited:   t.maxDecodedLength > 0,
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Header.Set(originalEncodingHeader, encoding)
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp
+}
+
+// cloneRequest makes a shallow copy of req with its own header,
+// a RoundTripper must not modify req
+func cloneRequest(req *http.Request) *http.Request {
+	clone := *req
+	clone.Header = req.Header.Clone()
+	return &clone
+}
+
+// OriginalEncoding returns the Content-Encoding resp had
+// before Transport decoded it, empty if it wasn't decoded
+func OriginalEncoding(resp *http.Response) string {
+	if !resp.Uncompressed {
+		return ""
+	}
+	return resp.Header.Get(originalEncodingHeader)
+}
@@ -0,0 +1,195 @@
+package brotli
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTransportTestServer(t *testing.T) *httptest.Server {
+	var compressed = DefaultHandler().HTTP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Accept-Encoding", req.Header.Get("Accept-Encoding"))
+		_, _ = w.Write(bigPayload)
+	}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/gzip":
+			var buffer bytes.Buffer
+			gw := gzip.NewWriter(&buffer)
+			_, _ = gw.Write(bigPayload)
+			_ = gw.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(buffer.Bytes())
+		case "/identity":
+			_, _ = w.Write(bigPayload)
+		default:
+			compressed.ServeHTTP(w, req)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTransport(t *testing.T) {
+	var (
+		server = newTransportTestServer(t)
+		client = &http.Client{Transport: NewTransport(TransportConfig{})}
+	)
+
+	for path, encoding := range map[string]string{
+		"/":         "br",
+		"/gzip":     "gzip",
+		"/identity": "",
+	} {
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(server.URL + path)
+			require.NoError(t, err)
+
+			assert.Empty(t, resp.Header.Get("Content-Encoding"), path)
+			assert.Equal(t, encoding, OriginalEncoding(resp), path)
+			if encoding != "" {
+				assert.Empty(t, resp.Header.Get("Content-Length"), path)
+				assert.EqualValues(t, -1, resp.ContentLength, path)
+				assert.True(t, resp.Uncompressed, path)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, bigPayload, body, path)
+		}
+	}
+}
+
+func TestTransport_ClientTimeout(t *testing.T) {
+	var (
+		server = newTransportTestServer(t)
+		// http.Client wraps the body of responses to enforce Timeout
+		client = &http.Client{Transport: NewTransport(TransportConfig{}), Timeout: 5 * time.Second}
+	)
+
+	for path, encoding := range map[string]string{
+		"/":         "br",
+		"/gzip":     "gzip",
+		"/identity": "",
+	} {
+		resp, err := client.Get(server.URL + path)
+		require.NoError(t, err)
+		assert.Equal(t, encoding, OriginalEncoding(resp), path)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, bigPayload, body, path)
+	}
+}
+
+func TestTransport_AcceptEncoding(t *testing.T) {
+	var (
+		server = newTransportTestServer(t)
+		client = &http.Client{Transport: NewTransport(TransportConfig{})}
+	)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, acceptEncoding, resp.Header.Get("X-Accept-Encoding"))
+	// the request is left untouched
+	assert.Empty(t, req.Header.Get("Accept-Encoding"))
+
+	// set by caller, response isn't decoded
+	req.Header.Set("Accept-Encoding", "br")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, OriginalEncoding(resp))
+}
+
+func TestTransport_MaxDecodedLength(t *testing.T) {
+	var server = newTransportTestServer(t)
+
+	for length, expected := range map[int64]error{
+		int64(len(bigPayload)) - 1: ErrDecodedBodyTooLarge,
+		int64(len(bigPayload)):     nil,
+		math.MaxInt64:              nil,
+	} {
+		for _, path := range []string{"/", "/gzip"} {
+			client := &http.Client{Transport: NewTransport(TransportConfig{MaxDecodedLength: length})}
+			resp, err := client.Get(server.URL + path)
+			require.NoError(t, err)
+
+			body, err := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			assert.Equal(t, expected, err, path)
+			if expected == nil {
+				assert.Equal(t, bigPayload, body, path)
+			}
+		}
+	}
+}
+
+func TestTransport_RequestCompression(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding := req.Header.Get("Content-Encoding")
+		requests = append(requests, req.URL.Path+" "+encoding)
+
+		switch {
+		case req.URL.Path == "/redirect":
+			http.Redirect(w, req, "/", http.StatusTemporaryRedirect)
+			return
+		case req.URL.Path == "/identity" && encoding != "":
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var body io.Reader = req.Body
+		if encoding == "br" {
+			body = brotli.NewReader(req.Body)
+		}
+		// net/http doesn't allow reading request body after writing response
+		payload, _ := ioutil.ReadAll(body)
+		_, _ = w.Write(payload)
+	}))
+	t.Cleanup(server.Close)
+
+	client := &http.Client{Transport: NewTransport(TransportConfig{MinRequestLength: 1024})}
+	for _, tc := range []struct {
+		path     string
+		payload  []byte
+		requests []string
+	}{
+		{"/", bigPayload, []string{"/ br"}},
+		{"/", smallPayload, []string{"/ "}},
+		{"/redirect", bigPayload, []string{"/redirect br", "/ br"}},
+		{"/identity", bigPayload, []string{"/identity br", "/identity "}},
+		// remembered per host
+		{"/identity", bigPayload, []string{"/identity "}},
+	} {
+		requests = nil
+		resp, err := client.Post(server.URL+tc.path, "application/json", bytes.NewReader(tc.payload))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, tc.path)
+		assert.Equal(t, tc.payload, body, tc.path)
+		assert.Equal(t, tc.requests, requests, tc.path)
+	}
+}
@@ -0,0 +1,104 @@
+package brotli
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// FieldError describes an invalid configuration field
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// Error implements error interface
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError reports every invalid field of a configuration
+type ValidationError []FieldError
+
+// Error implements error interface
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, field := range e {
+		messages = append(messages, field.Error())
+	}
+	return "brotli: invalid configuration: " + strings.Join(messages, "; ")
+}
+
+// add records field as invalid
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns e if any field is invalid, nil otherwise
+func (e ValidationError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate reports every invalid field of c in a ValidationError,
+// zero MinContentLength is valid and stands for DefalutContentLen
+func (c Config) Validate() error {
+	var errs ValidationError
+
+	if c.CompressionLevel < BestSpeed || c.CompressionLevel > BestCompression {
+		errs.add("CompressionLevel", "%d is not between %d and %d", c.CompressionLevel, BestSpeed, BestCompression)
+	}
+	minContentLength := c.MinContentLength
+	if minContentLength < 0 {
+		errs.add("MinContentLength", "must not be negative")
+	} else if minContentLength == 0 {
+		minContentLength = DefalutContentLen
+	}
+	if c.MaxContentLength < 0 {
+		errs.add("MaxContentLength", "must not be negative")
+	} else if c.MaxContentLength > 0 && c.MaxContentLength < minContentLength {
+		errs.add("MaxContentLength", "must not be less than MinContentLength %d", minContentLength)
+	}
+	if c.BufferedMaxLength < 0 {
+		errs.add("BufferedMaxLength", "must not be negative")
+	}
+	if c.ETagStrategy < ETagWeaken || c.ETagStrategy > ETagKeep {
+		errs.add("ETagStrategy", "unknown strategy %d", c.ETagStrategy)
+	}
+	switch c.ContentDigest {
+	case "", DigestSHA256, DigestSHA512:
+	default:
+		errs.add("ContentDigest", "must be %s or %s", DigestSHA256, DigestSHA512)
+	}
+	for _, code := range c.StatusCodes {
+		if !compressibleStatus(code) {
+			errs.add("StatusCodes", "%d can not be compressed", code)
+		}
+	}
+	for i, filter := range c.RequestFilter {
+		if filter == nil {
+			errs.add(fmt.Sprintf("RequestFilter[%d]", i), "must not be nil")
+		}
+	}
+	for i, filter := range c.ResponseHeaderFilter {
+		if filter == nil {
+			errs.add(fmt.Sprintf("ResponseHeaderFilter[%d]", i), "must not be nil")
+		}
+	}
+	for i, filter := range c.ResponseFilter {
+		if filter == nil {
+			errs.add(fmt.Sprintf("ResponseFilter[%d]", i), "must not be nil")
+		}
+	}
+	return errs.err()
+}
+
+// compressibleStatus reports whether responses of code may carry
+// a compressed body, error pages may, 1xx, 204 and 304 carry no body
+// and partial content is never compressed
+func compressibleStatus(code int) bool {
+	return code >= 200 && code <= 999 && code != http.StatusNoContent &&
+		code != http.StatusNotModified && code != http.StatusPartialContent
+}
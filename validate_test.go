@@ -0,0 +1,62 @@
+package brotli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, defaultConfig.Validate())
+	assert.NoError(t, Config{}.Validate())
+
+	config := Config{
+		CompressionLevel:  12,
+		MinContentLength:  -1,
+		MaxContentLength:  512,
+		BufferedMaxLength: -1,
+		ETagStrategy:      ETagKeep + 1,
+		ContentDigest:     "md5",
+		StatusCodes:       []int{200, 206, 304},
+		RequestFilter:     []RequestFilter{NewCommonRequestFilter(), nil},
+		ResponseHeaderFilter: []ResponseHeaderFilter{
+			nil,
+		},
+		ResponseFilter: []ResponseFilter{
+			NewMagicBytesFilter(),
+			nil,
+		},
+	}
+	err := config.Validate()
+	require.IsType(t, ValidationError{}, err)
+
+	var fields []string
+	for _, field := range err.(ValidationError) {
+		fields = append(fields, field.Field)
+	}
+	assert.Equal(t, []string{
+		"CompressionLevel", "MinContentLength", "BufferedMaxLength",
+		"ETagStrategy", "ContentDigest", "StatusCodes", "StatusCodes",
+		"RequestFilter[1]", "ResponseHeaderFilter[0]", "ResponseFilter[1]",
+	}, fields)
+
+	// error pages carry bodies and may be compressed
+	assert.NoError(t, Config{StatusCodes: []int{200, 404, 500}}.Validate())
+
+	// MaxContentLength is compared with the default MinContentLength
+	err = Config{MaxContentLength: 512}.Validate()
+	require.IsType(t, ValidationError{}, err)
+	assert.Equal(t, "brotli: invalid configuration: MaxContentLength: must not be less than MinContentLength 1024", err.Error())
+}
+
+func TestNewHandlerStrict(t *testing.T) {
+	handler, err := NewHandlerStrict(Config{CompressionLevel: -1, MinContentLength: -1})
+	assert.Nil(t, handler)
+	assert.Error(t, err)
+
+	handler, err = NewHandlerStrict(defaultConfig)
+	require.NoError(t, err)
+	assert.Equal(t, defaultConfig.CompressionLevel, handler.Config().CompressionLevel)
+	assert.Equal(t, defaultConfig.MinContentLength, handler.Config().MinContentLength)
+}
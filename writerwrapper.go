@@ -1,20 +1,44 @@
 package brotli
 
 import (
+	"bytes"
 	"fmt"
+	"hash"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/andybalholm/brotli"
 )
 
 type writerWrapper struct {
 	Filters          []ResponseHeaderFilter
+	ResponseFilters  []ResponseFilter
 	MinContentLength int64
-	OriginWriter     http.ResponseWriter
-	brotliWriter     *brotli.Writer
-	GetBrotliWriter  func() *brotli.Writer
-	PutBrotliWriter  func(*brotli.Writer)
+	MaxContentLength int64
+	// BufferedMaxLength enables buffer-then-send for responses up to this length,
+	// 0 means always streaming
+	BufferedMaxLength int64
+	ETagStrategy      ETagStrategy
+	// ContentDigest is the algorithm of digest computed over encoded content,
+	// empty means disabled
+	ContentDigest string
+	// CompressionTrailers enables trailers of compression stats
+	CompressionTrailers bool
+	// ServerTiming enables Server-Timing metric of compression
+	ServerTiming bool
+	// StatusCodes are status codes eligible for compression,
+	// empty means 200 only
+	StatusCodes     []int
+	OriginWriter    http.ResponseWriter
+	Request         *http.Request
+	brotliWriter    *brotli.Writer
+	GetBrotliWriter func() *brotli.Writer
+	PutBrotliWriter func(*brotli.Writer)
+	// state is the handler state w is pooled in
+	state *handlerState
 
 	shouldCompress        bool
 	bodyBigEnough         bool
@@ -23,6 +47,65 @@ type writerWrapper struct {
 	statusCode            int
 	size                  int
 	bodyBuffer            []byte
+	responseContext       ResponseContext
+	// compressBuffering is true while compressed output is held in sink
+	compressBuffering bool
+	// compressedLength is sent as Content-Length if not negative
+	compressedLength int64
+	sink             compressedSink
+	// etagMapped is true if conditional request headers carried etagSuffix
+	etagMapped bool
+	digest     hash.Hash
+	// legacyDigest is true if handler set Digest
+	legacyDigest bool
+	// compressDuration is the time spent in brotli writer
+	compressDuration time.Duration
+	// serverTimingTrailer is true if handler declared Server-Timing trailer
+	serverTimingTrailer bool
+}
+
+// compressedSink receives brotli output, holding it in memory
+// until a destination is attached
+type compressedSink struct {
+	buffer bytes.Buffer
+	dst    io.Writer
+	// hash, if not nil, sees all output
+	hash hash.Hash
+	// written is the length of all output
+	written int64
+	// writeDuration is the time spent writing to dst,
+	// measured only if timed
+	writeDuration time.Duration
+	timed         bool
+}
+
+// Write implements the io.Writer interface.
+func (s *compressedSink) Write(data []byte) (int, error) {
+	s.written += int64(len(data))
+	if s.hash != nil {
+		_, _ = s.hash.Write(data)
+	}
+	if s.dst == nil {
+		return s.buffer.Write(data)
+	}
+	if !s.timed {
+		return s.dst.Write(data)
+	}
+
+	start := time.Now()
+	n, err := s.dst.Write(data)
+	s.writeDuration += time.Since(start)
+	return n, err
+}
+
+// Reset empties the sink and detaches destination
+func (s *compressedSink) Reset() {
+	s.buffer.Reset()
+	s.dst = nil
+	s.hash = nil
+	s.written = 0
+	s.writeDuration = 0
+	s.timed = false
 }
 
 // interface verification
@@ -30,26 +113,44 @@ var _ http.ResponseWriter = &writerWrapper{}
 var _ http.Flusher = &writerWrapper{}
 
 func newWriterWrapper(filters []ResponseHeaderFilter,
+	responseFilters []ResponseFilter,
 	minContentLength int64,
+	maxContentLength int64,
+	bufferedMaxLength int64,
+	etagStrategy ETagStrategy,
+	contentDigest string,
+	compressionTrailers bool,
+	serverTiming bool,
+	statusCodes []int,
 	originWriter http.ResponseWriter,
 	getBrotliWriter func() *brotli.Writer,
 	putBrotliWriter func(*brotli.Writer)) *writerWrapper {
 
 	return &writerWrapper{
-		shouldCompress:   true,
-		bodyBuffer:       make([]byte, 0, minContentLength),
-		Filters:          filters,
-		MinContentLength: minContentLength,
-		OriginWriter:     originWriter,
-		GetBrotliWriter:  getBrotliWriter,
-		PutBrotliWriter:  putBrotliWriter,
+		shouldCompress:      true,
+		bodyBuffer:          make([]byte, 0, minContentLength),
+		Filters:             filters,
+		ResponseFilters:     responseFilters,
+		MinContentLength:    minContentLength,
+		MaxContentLength:    maxContentLength,
+		BufferedMaxLength:   bufferedMaxLength,
+		ETagStrategy:        etagStrategy,
+		ContentDigest:       contentDigest,
+		CompressionTrailers: compressionTrailers,
+		ServerTiming:        serverTiming,
+		StatusCodes:         statusCodes,
+		OriginWriter:        originWriter,
+		GetBrotliWriter:     getBrotliWriter,
+		PutBrotliWriter:     putBrotliWriter,
+		compressedLength:    -1,
 	}
 }
 
 // Reset the wrapper into a fresh one,
-// writing to originWriter
-func (w *writerWrapper) Reset(originWriter http.ResponseWriter) {
+// writing to originWriter in response to req
+func (w *writerWrapper) Reset(originWriter http.ResponseWriter, req *http.Request) {
 	w.OriginWriter = originWriter
+	w.Request = req
 
 	// internal below
 
@@ -61,6 +162,14 @@ func (w *writerWrapper) Reset(originWriter http.ResponseWriter) {
 	w.bodyBigEnough = false
 	w.statusCode = 0
 	w.size = 0
+	w.responseContext = ResponseContext{}
+	w.compressBuffering = false
+	w.compressedLength = -1
+	w.sink.Reset()
+	w.etagMapped = false
+	w.legacyDigest = false
+	w.compressDuration = 0
+	w.serverTimingTrailer = false
 
 	if w.brotliWriter != nil {
 		w.PutBrotliWriter(w.brotliWriter)
@@ -83,7 +192,7 @@ func (w *writerWrapper) Size() int {
 
 // Written implement the gin.ResponseWriter interface.
 func (w *writerWrapper) Written() bool {
-	return w.headerFlushed || len(w.bodyBuffer) > 0
+	return w.headerFlushed || w.bodyBigEnough || len(w.bodyBuffer) > 0
 }
 
 func (w *writerWrapper) WriteHeaderCalled() bool {
@@ -93,7 +202,120 @@ func (w *writerWrapper) WriteHeaderCalled() bool {
 // initBrotliWriter
 func (w *writerWrapper) initBrotliWriter() {
 	w.brotliWriter = w.GetBrotliWriter()
-	w.brotliWriter.Reset(w.OriginWriter)
+	if !w.compressBuffering {
+		w.sink.dst = w.OriginWriter
+	}
+	w.sink.timed = w.timed()
+	w.brotliWriter.Reset(&w.sink)
+}
+
+// timed reports whether time spent in compression is measured
+func (w *writerWrapper) timed() bool {
+	return w.CompressionTrailers || w.ServerTiming
+}
+
+// compress writes data to brotli writer
+func (w *writerWrapper) compress(data []byte) (int, error) {
+	if !w.sink.timed {
+		return w.brotliWriter.Write(data)
+	}
+
+	start := time.Now()
+	n, err := w.brotliWriter.Write(data)
+	w.compressDuration += time.Since(start)
+	return n, err
+}
+
+// closeBrotliWriter flushes remaining output of brotli writer
+func (w *writerWrapper) closeBrotliWriter() {
+	start := time.Now()
+	_ = w.brotliWriter.Close()
+	if w.sink.timed {
+		w.compressDuration += time.Since(start)
+	}
+}
+
+// stats of compression
+func (w *writerWrapper) stats() compressionStats {
+	return compressionStats{
+		uncompressed: int64(w.size),
+		compressed:   w.sink.written,
+		duration:     w.compressDuration - w.sink.writeDuration,
+	}
+}
+
+// declareTrailers announces trailers to be set by setTrailers
+func (w *writerWrapper) declareTrailers(header http.Header) {
+	if w.sink.hash != nil {
+		header.Add("Trailer", "Content-Digest")
+		if w.legacyDigest {
+			header.Add("Trailer", "Digest")
+		}
+	}
+	if w.CompressionTrailers {
+		header.Add("Trailer", UncompressedLengthTrailer)
+		header.Add("Trailer", CompressionRatioTrailer)
+	}
+	if w.timed() {
+		w.serverTimingTrailer = hasToken(header.Values("Trailer"), "Server-Timing")
+		if !w.serverTimingTrailer {
+			header.Add("Trailer", "Server-Timing")
+		}
+	}
+}
+
+// setTrailers sets values computed over the whole content,
+// they're sent as trailers if header is flushed, or as headers otherwise.
+func (w *writerWrapper) setTrailers() {
+	w.setDigest()
+	if !w.timed() {
+		return
+	}
+
+	var (
+		header = w.Header()
+		stats  = w.stats()
+	)
+	if w.CompressionTrailers {
+		header.Set(UncompressedLengthTrailer, strconv.FormatInt(stats.uncompressed, 10))
+		header.Set(CompressionRatioTrailer, strconv.FormatFloat(stats.ratio(), 'f', 2, 64))
+	}
+	if w.headerFlushed && !w.serverTimingTrailer {
+		// entries of handler were sent in header
+		header.Set("Server-Timing", stats.serverTiming())
+	} else {
+		mergeServerTiming(header, stats.serverTiming())
+	}
+}
+
+// initDigest starts digest of encoded content,
+// digests describing identity content are dropped
+func (w *writerWrapper) initDigest() {
+	if w.ContentDigest == "" {
+		return
+	}
+	if w.digest == nil {
+		w.digest = newDigestHash(w.ContentDigest)
+		if w.digest == nil {
+			return
+		}
+	}
+
+	header := w.Header()
+	w.legacyDigest = header.Get("Digest") != ""
+	header.Del("Content-Digest")
+	header.Del("Digest")
+	w.digest.Reset()
+	w.sink.hash = w.digest
+}
+
+// setDigest sets digest of encoded content to header,
+// they're sent as trailers if header is flushed.
+func (w *writerWrapper) setDigest() {
+	if w.sink.hash == nil {
+		return
+	}
+	setContentDigest(w.Header(), w.ContentDigest, w.sink.hash.Sum(nil), w.legacyDigest)
 }
 
 // Header implements the http.ResponseWriter interface.
@@ -110,49 +332,213 @@ func (w *writerWrapper) Write(data []byte) (int, error) {
 	}
 
 	if !w.shouldCompress {
+		w.WriteHeaderNow()
 		return w.OriginWriter.Write(data)
 	}
 	if w.bodyBigEnough {
-		return w.brotliWriter.Write(data)
+		return w.writeCompressed(data)
 	}
 
 	// fast check
 	if !w.responseHeaderChecked {
-		w.responseHeaderChecked = true
+		if !w.checkResponseHeader() {
+			w.shouldCompress = false
+			w.WriteHeaderNow()
+			return w.OriginWriter.Write(data)
+		}
 
-		// 响应数据校验
-		header := w.Header()
-		for _, filter := range w.Filters {
-			w.shouldCompress = filter.ShouldCompress(header)
-			if !w.shouldCompress {
-				w.WriteHeaderNow()
+		// a declared length decides without buffering
+		if length := declaredContentLength(w.Header()); length >= 0 {
+			if !lengthAllowed(w.MinContentLength, w.MaxContentLength, length) {
+				w.skipForSize()
 				return w.OriginWriter.Write(data)
 			}
+			return w.startCompression(data)
 		}
 	}
 
 	// check buffer length
 	if !w.writeBuffer(data) {
-		w.bodyBigEnough = true
+		return w.startCompression(data)
+	}
+
+	return len(data), nil
+}
+
+// checkResponseHeader runs ResponseHeaderFilters against header
+func (w *writerWrapper) checkResponseHeader() bool {
+	w.responseHeaderChecked = true
+	return headerAllowed(w.Filters, w.Header())
+}
+
+// headerAllowed reports whether a response with header may be compressed,
+// it must not be encoded already and must pass filters
+func headerAllowed(filters []ResponseHeaderFilter, header http.Header) bool {
+	// 已编码的响应不再压缩
+	if encoding := header.Get("Content-Encoding"); encoding != "" &&
+		!strings.EqualFold(strings.TrimSpace(encoding), "identity") {
+		return false
+	}
+
+	// 响应数据校验
+	for _, filter := range filters {
+		if !filter.ShouldCompress(header) {
+			return false
+		}
+	}
+	return true
+}
+
+// lengthAllowed checks length of content against limits,
+// content outside them is sent with Vary: Accept-Encoding
+func lengthAllowed(minContentLength, maxContentLength, length int64) bool {
+	return length > minContentLength &&
+		(maxContentLength <= 0 || length <= maxContentLength)
+}
+
+// responseAllowed runs filters against responseContext
+func responseAllowed(filters []ResponseFilter, responseContext *ResponseContext) bool {
+	for _, filter := range filters {
+		if !filter.ShouldCompress(responseContext) {
+			return false
+		}
+	}
+	return true
+}
 
-		// detect Content-Type if there's none
-		if header := w.Header(); header.Get("Content-Type") == "" {
+// setEncodedHeader updates header for content encoded with brotli,
+// Content-Length of the encoded content is left to the caller
+func setEncodedHeader(header http.Header, strategy ETagStrategy) {
+	header.Del("Content-Length")
+	// ranges of the compressed stream are not served
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", "br")
+	addVary(header, "Accept-Encoding")
+	rewriteETag(header, strategy)
+}
+
+// mapsETag reports whether ETag of an uncompressed response is to be
+// rewritten still, 304 and 412 answer validators of the brotli content
+func mapsETag(etagMapped bool, statusCode int) bool {
+	return etagMapped && (statusCode == http.StatusNotModified ||
+		statusCode == http.StatusPreconditionFailed)
+}
+
+// skipForSize sends eligible content uncompressed for its size,
+// caches still need to know the response varies on Accept-Encoding
+func (w *writerWrapper) skipForSize() {
+	w.shouldCompress = false
+	addVary(w.Header(), "Accept-Encoding")
+	w.WriteHeaderNow()
+}
+
+// isHead reports whether the body is never sent
+func (w *writerWrapper) isHead() bool {
+	return w.Request != nil && w.Request.Method == http.MethodHead
+}
+
+// startCompression makes the final decision on compression,
+// flushes header and writes buffered content along with data.
+func (w *writerWrapper) startCompression(data []byte) (int, error) {
+	// detect Content-Type if there's none
+	if header := w.Header(); header.Get("Content-Type") == "" && w.size > 0 {
+		if len(w.bodyBuffer) > 0 {
 			header.Set("Content-Type", http.DetectContentType(w.bodyBuffer))
+		} else {
+			header.Set("Content-Type", http.DetectContentType(data))
 		}
+	}
 
+	// 响应上下文校验
+	if !w.checkResponseFilters(data) {
+		w.shouldCompress = false
 		w.WriteHeaderNow()
-		w.initBrotliWriter()
 		if len(w.bodyBuffer) > 0 {
-			written, err := w.brotliWriter.Write(w.bodyBuffer)
-			if err != nil {
-				err = fmt.Errorf("w.brotliWriter.Write: %w", err)
-				return written, err
+			if _, err := w.OriginWriter.Write(w.bodyBuffer); err != nil {
+				return 0, err
 			}
 		}
-		return w.brotliWriter.Write(data)
+		return w.OriginWriter.Write(data)
 	}
 
-	return len(data), nil
+	w.bodyBigEnough = true
+	// headers as GET would have, without running the encoder
+	if w.isHead() {
+		w.WriteHeaderNow()
+		return len(data), nil
+	}
+
+	if w.BufferedMaxLength > 0 && int64(w.size) <= w.BufferedMaxLength {
+		length := declaredContentLength(w.Header())
+		w.compressBuffering = length < 0 || length <= w.BufferedMaxLength
+	}
+	w.initDigest()
+	if !w.compressBuffering {
+		w.WriteHeaderNow()
+	}
+	w.initBrotliWriter()
+	if len(w.bodyBuffer) > 0 {
+		written, err := w.compress(w.bodyBuffer)
+		if err != nil {
+			err = fmt.Errorf("w.brotliWriter.Write: %w", err)
+			return written, err
+		}
+	}
+	return w.writeCompressed(data)
+}
+
+// writeCompressed writes data to brotli writer,
+// switching to streaming if buffered content grows too long.
+func (w *writerWrapper) writeCompressed(data []byte) (int, error) {
+	if w.brotliWriter == nil {
+		// HEAD
+		return len(data), nil
+	}
+	if w.compressBuffering && int64(w.size) > w.BufferedMaxLength {
+		if err := w.startStreaming(); err != nil {
+			return 0, err
+		}
+	}
+	return w.compress(data)
+}
+
+// startStreaming leaves buffer-then-send mode,
+// flushing header and compressed content held so far
+func (w *writerWrapper) startStreaming() error {
+	w.compressBuffering = false
+	w.WriteHeaderNow()
+	w.sink.dst = w.OriginWriter
+	if w.sink.buffer.Len() > 0 {
+		if _, err := w.OriginWriter.Write(w.sink.buffer.Bytes()); err != nil {
+			return err
+		}
+		w.sink.buffer.Reset()
+	}
+	return nil
+}
+
+// checkResponseFilters runs ResponseFilters against the response,
+// data is the pending write that didn't fit in bodyBuffer
+func (w *writerWrapper) checkResponseFilters(data []byte) bool {
+	if len(w.ResponseFilters) == 0 {
+		return true
+	}
+
+	header := w.Header()
+	w.responseContext = ResponseContext{
+		Request:       w.Request,
+		StatusCode:    w.statusCode,
+		Header:        header,
+		Buffered:      w.bodyBuffer,
+		ContentLength: declaredContentLength(header),
+	}
+	if len(w.bodyBuffer) == 0 {
+		w.responseContext.Buffered = data
+	}
+
+	shouldCompress := responseAllowed(w.ResponseFilters, &w.responseContext)
+	w.responseContext = ResponseContext{}
+	return shouldCompress
 }
 
 // writeBuffer
@@ -168,34 +554,53 @@ func (w *writerWrapper) writeBuffer(data []byte) bool {
 // WriteHeader implements the http.ResponseWriter interface.
 //
 // WriteHeader does not really calls originalHandler's WriteHeader,
-// and the calling will actually be handler by WriteHeaderNow().
+// and the calling will actually be handled by WriteHeaderNow(),
+// so header is still open to changes until then.
 //
 // http.ResponseWriter does not specify clearly whether permitting
 // updating status code on second call to WriteHeader(), and it's
 // conflicting between http and gin's implementation.
 // Here, brotli consider second(and furthermore) calls to WriteHeader()
 // valid. WriteHeader() is disabled after flushing header.
-// Do note setting status not 200 marks content uncompressable,
+// Do note setting status not in StatusCodes marks content uncompressable,
 // and a later status code change does not revert this.
+// 206 Partial Content, whose ranges refer to identity content,
+// is always left untouched.
 func (w *writerWrapper) WriteHeader(statusCode int) {
-	if w.headerFlushed {
+	if w.headerFlushed || w.bodyBigEnough {
 		return
 	}
 
 	w.statusCode = statusCode
-	// write http status
-	w.OriginWriter.WriteHeader(w.statusCode)
 
 	if !w.shouldCompress {
 		return
 	}
 
-	if statusCode != http.StatusOK {
+	if !statusAllowed(w.StatusCodes, statusCode) {
 		w.shouldCompress = false
 		return
 	}
 }
 
+// statusAllowed reports whether responses of statusCode may be compressed,
+// empty statusCodes means 200 only
+func statusAllowed(statusCodes []int, statusCode int) bool {
+	if len(statusCodes) == 0 {
+		return statusCode == http.StatusOK
+	}
+	if statusCode == http.StatusPartialContent {
+		return false
+	}
+
+	for _, code := range statusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
 // WriteHeaderNow implement the gin.ResponseWriter interface.
 // WriteHeaderNow Forces to write the http header (status code + headers).
 //
@@ -217,13 +622,15 @@ func (w *writerWrapper) WriteHeaderNow() {
 
 	if w.shouldCompress {
 		header := w.Header()
-		header.Del("Content-Length")
-		header.Set("Content-Encoding", "br")
-		header.Add("Vary", "Accept-Encoding")
-		originalEtag := w.Header().Get("ETag")
-		if originalEtag != "" && !strings.HasPrefix(originalEtag, "W/") {
-			w.Header().Set("ETag", "W/"+originalEtag)
+		setEncodedHeader(header, w.ETagStrategy)
+		if w.compressedLength >= 0 {
+			header.Set("Content-Length", strconv.FormatInt(w.compressedLength, 10))
+		} else {
+			w.declareTrailers(header)
 		}
+	} else if mapsETag(w.etagMapped, w.statusCode) {
+		// validator the client holds is the brotli one
+		rewriteETag(w.Header(), w.ETagStrategy)
 	}
 
 	// write http status
@@ -234,30 +641,105 @@ func (w *writerWrapper) WriteHeaderNow() {
 
 // FinishWriting flushes header and closed brotli writer
 //
+// Trailers set by handler are sent by the server after FinishWriting
+// returns, hence always after the end of brotli stream.
+//
 // Write() and WriteHeader() should not be called
 // after FinishWriting()
 func (w *writerWrapper) FinishWriting() {
+	// HEAD without body, decided by declared length
+	if length := declaredContentLength(w.Header()); w.shouldCompress &&
+		!w.responseHeaderChecked && w.isHead() && length >= 0 {
+		if !w.WriteHeaderCalled() {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.shouldCompress {
+			switch {
+			case !w.checkResponseHeader():
+				w.shouldCompress = false
+			case lengthAllowed(w.MinContentLength, w.MaxContentLength, length):
+				_, _ = w.startCompression(nil)
+			default:
+				w.skipForSize()
+			}
+		}
+	}
+
 	// still buffering
 	if w.shouldCompress && !w.bodyBigEnough {
-		w.shouldCompress = false
-		w.WriteHeaderNow()
+		if w.responseHeaderChecked || w.checkResponseHeader() {
+			w.skipForSize()
+		} else {
+			w.shouldCompress = false
+			w.WriteHeaderNow()
+		}
 		if len(w.bodyBuffer) > 0 {
 			_, _ = w.OriginWriter.Write(w.bodyBuffer)
 		}
 	}
 
-	w.WriteHeaderNow()
 	if w.brotliWriter != nil {
+		// flush remaining output
+		w.closeBrotliWriter()
+
+		switch {
+		case w.compressBuffering && !declaresTrailers(w.Header()):
+			// compressed in memory, send with exact length
+			w.compressBuffering = false
+			w.compressedLength = int64(w.sink.buffer.Len())
+			w.setTrailers()
+			w.WriteHeaderNow()
+			_, _ = w.OriginWriter.Write(w.sink.buffer.Bytes())
+		case w.compressBuffering:
+			// trailers of handler can't go with Content-Length
+			_ = w.startStreaming()
+			w.setTrailers()
+		default:
+			// trailers after the closed stream
+			w.setTrailers()
+		}
+
 		w.PutBrotliWriter(w.brotliWriter)
 		w.brotliWriter = nil
+		w.sink.Reset()
 	}
+
+	w.WriteHeaderNow()
 }
 
 // Flush implements the http.Flusher interface.
+//
+// Flushing a compressing response switches it to streaming
+// and pushes out pending brotli output.
 func (w *writerWrapper) Flush() {
-	w.FinishWriting()
+	if w.bodyBigEnough && w.brotliWriter != nil {
+		if w.compressBuffering {
+			_ = w.startStreaming()
+		}
+		start := time.Now()
+		_ = w.brotliWriter.Flush()
+		if w.sink.timed {
+			w.compressDuration += time.Since(start)
+		}
+	} else {
+		w.FinishWriting()
+	}
 
 	if flusher, ok := w.OriginWriter.(http.Flusher); ok {
 		flusher.Flush()
 	}
 }
+
+// addVary adds token to Vary unless it's listed
+// in any Vary line already, or Vary is *
+func addVary(header http.Header, token string) {
+	for _, line := range header.Values("Vary") {
+		for _, item := range strings.Split(line, ",") {
+			item = strings.TrimSpace(item)
+			if item == "*" || strings.EqualFold(item, token) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", token)
+}